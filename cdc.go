@@ -0,0 +1,230 @@
+package librsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Content-defined chunking as in FastCDC. Chunk boundaries are placed where a
+// gear hash of the preceding bytes matches a mask, so they move along with the
+// data on insertions and deletions instead of being fixed multiples of
+// blockLen. The signature's block length is the average chunk size, chunks
+// are between a quarter and eight times that long.
+
+// Bounds of the block length of CDC signatures. Chunks are buffered whole and
+// are at most cdcMaxChunkLen long.
+const (
+	cdcMinBlockLen = 64
+	cdcMaxBlockLen = 16 << 20
+)
+
+func cdcMaxChunkLen(blockLen uint32) uint64 {
+	return 8 * uint64(blockLen)
+}
+
+type cdcChunk struct {
+	offset uint64
+	length uint32
+}
+
+// gearTable maps each byte to a random 64bit value. It is generated from a
+// fixed seed and is part of the CDC_BLAKE2_SIG_MAGIC format, so it must never
+// change.
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x72730157)
+	for i := range gearTable {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+type chunker struct {
+	min, avg, max int
+	// maskS is used before the average size is reached and has more bits
+	// set than maskL, which makes boundaries cluster around the average.
+	maskS, maskL uint64
+}
+
+func newChunker(avg uint32) chunker {
+	b := bits.Len32(avg) - 1
+	if b < 2 {
+		b = 2
+	}
+	return chunker{
+		min:   int(avg / 4),
+		avg:   int(avg),
+		max:   int(cdcMaxChunkLen(avg)),
+		maskS: ^uint64(0) << uint(64-b-1),
+		maskL: ^uint64(0) << uint(64-b+1),
+	}
+}
+
+// boundary returns the length of the chunk starting at p. p must hold c.max
+// bytes unless the input ends sooner.
+func (c *chunker) boundary(p []byte) int {
+	n := len(p)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[p[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[p[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunks calls fn for every content-defined chunk of input in order.
+func (c *chunker) chunks(input io.Reader, fn func(chunk []byte) error) error {
+	buf := make([]byte, c.max)
+	n := 0
+	eof := false
+
+	for {
+		if !eof {
+			m, err := io.ReadFull(input, buf[n:])
+			n += m
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+
+		l := c.boundary(buf[:n])
+		if err := fn(buf[:l]); err != nil {
+			return err
+		}
+		n = copy(buf, buf[l:n])
+	}
+}
+
+func signatureCDC(input io.Reader, output io.Writer, sig *SignatureType) error {
+	c := newChunker(sig.blockLen)
+	offset := uint64(0)
+
+	return c.chunks(input, func(chunk []byte) error {
+		ch := cdcChunk{offset: offset, length: uint32(len(chunk))}
+		offset += uint64(len(chunk))
+
+		strong, err := sig.strongSum(chunk)
+		if err != nil {
+			return err
+		}
+		if err := writeChunk(output, ch, strong); err != nil {
+			return err
+		}
+
+		sig.addChunk(ch, strong)
+		return nil
+	})
+}
+
+func writeChunk(output io.Writer, ch cdcChunk, strong []byte) error {
+	err := binary.Write(output, binary.BigEndian, ch.offset)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(output, binary.BigEndian, ch.length)
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(strong)
+	return err
+}
+
+func readSignatureCDC(input io.Reader, sig *SignatureType) error {
+	for {
+		var ch cdcChunk
+		err := binary.Read(input, binary.BigEndian, &ch.offset)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		err = binary.Read(input, binary.BigEndian, &ch.length)
+		if err != nil {
+			return err
+		}
+		if uint64(ch.length) > cdcMaxChunkLen(sig.blockLen) {
+			return fmt.Errorf("chunk of %d bytes exceeds %d", ch.length, cdcMaxChunkLen(sig.blockLen))
+		}
+
+		strong := make([]byte, sig.strongLen)
+		if _, err := io.ReadFull(input, strong); err != nil {
+			return err
+		}
+
+		sig.addChunk(ch, strong)
+	}
+}
+
+func (s *SignatureType) addChunk(ch cdcChunk, strong []byte) {
+	if s.strong2chunk == nil {
+		s.strong2chunk = make(map[string]int)
+	}
+	s.strong2chunk[string(strong)] = len(s.strongSigs)
+	s.strongSigs = append(s.strongSigs, strong)
+	s.chunks = append(s.chunks, ch)
+}
+
+// deltaCDC finds the chunk boundaries of input the same way signatureCDC did
+// for the basis and feeds a copy of every chunk whose strong sum is known, or
+// its literal data otherwise, into m.
+func deltaCDC(sig *SignatureType, input *bufio.Reader, m *match, basis io.ReaderAt) error {
+	c := newChunker(sig.blockLen)
+
+	return c.chunks(input, func(chunk []byte) error {
+		strong, err := sig.strongSum(chunk)
+		if err != nil {
+			return err
+		}
+
+		if idx, ok := sig.strong2chunk[string(strong)]; ok && sig.chunks[idx].length == uint32(len(chunk)) && sig.chunks[idx].offset >= m.copyFloor() {
+			pos, length := sig.chunks[idx].offset, uint64(len(chunk))
+			if basis != nil {
+				pos, length, err = extendBackward(basis, m, pos, length)
+				if err != nil {
+					return err
+				}
+			}
+			return m.add(MATCH_KIND_COPY, pos, length)
+		}
+
+		for _, b := range chunk {
+			if err := m.add(MATCH_KIND_LITERAL, uint64(b), 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,97 @@
+package librsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// PatchChain applies deltas to base one after the other and writes the result
+// of the last one to out. The intermediate versions are never produced, every
+// delta is mapped through the previous ones onto base in memory instead,
+// which takes about as much memory as the literal data of all deltas. The
+// headers and checksums of the deltas are verified against the first basis,
+// the versions in between as far as the deltas describe them and the final
+// output.
+func PatchChain(base io.ReaderAt, deltas []io.Reader, out io.Writer) error {
+	if len(deltas) == 0 {
+		return fmt.Errorf("no deltas to apply")
+	}
+
+	var first, target *segmentMap
+	for i, delta := range deltas {
+		m, err := readSegments(delta, target)
+		if err != nil {
+			return err
+		}
+		if first == nil {
+			first = m
+		} else if err := m.checkBasisMap(target); err != nil {
+			return fmt.Errorf("delta %d: %v", i, err)
+		}
+		target = m
+	}
+
+	if first.header != nil {
+		if err := first.header.checkBasisAt(base); err != nil {
+			return err
+		}
+	}
+	if len(first.basisChecksum) > 0 {
+		sum, err := WholeFileChecksum(io.NewSectionReader(base, 0, 1<<63-1))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(sum, first.basisChecksum) {
+			return ErrBasisChecksumMismatch
+		}
+	}
+
+	checksum, _ := blake2b.New256(nil)
+	out = io.MultiWriter(out, checksum)
+
+	err := target.resolve(0, target.size, func(kind matchKind, pos, length uint64, lit []byte) error {
+		if kind == MATCH_KIND_LITERAL {
+			_, err := out.Write(lit)
+			return err
+		}
+
+		n, err := io.Copy(out, io.NewSectionReader(base, int64(pos), int64(length)))
+		if err != nil {
+			return err
+		}
+		if n != int64(length) {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if target.checksum != nil && !bytes.Equal(checksum.Sum(nil), target.checksum) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// checkBasisMap checks the basis that s expects against basis, the map of the
+// output of the previous delta, as far as both deltas record it.
+func (s *segmentMap) checkBasisMap(basis *segmentMap) error {
+	expected := [][]byte{s.basisChecksum}
+	if s.header != nil {
+		if s.header.BasisLen >= 0 && uint64(s.header.BasisLen) != basis.size {
+			return fmt.Errorf("basis is %d bytes rather than expected %d", basis.size, s.header.BasisLen)
+		}
+		expected = append(expected, s.header.BasisChecksum)
+	}
+
+	for _, e := range expected {
+		if len(e) > 0 && basis.checksum != nil && !bytes.Equal(e, basis.checksum) {
+			return ErrBasisChecksumMismatch
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package librsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var (
+	// ErrChecksumMismatch is returned by Patch when the output doesn't match
+	// the checksum recorded in the delta.
+	ErrChecksumMismatch = errors.New("checksum of patched output doesn't match the delta")
+	// ErrBasisChecksumMismatch is returned by Patch when the basis isn't the
+	// one the delta was created against.
+	ErrBasisChecksumMismatch = errors.New("checksum of basis doesn't match the delta")
+)
+
+// WholeFileChecksum returns the BLAKE2 hash of everything read from r, as
+// recorded by deltas created with DeltaOptions.Checksum.
+func WholeFileChecksum(r io.Reader) ([]byte, error) {
+	d, _ := blake2b.New256(nil)
+	if _, err := io.Copy(d, r); err != nil {
+		return nil, err
+	}
+	return d.Sum(nil), nil
+}
+
+// The OP_CHECKSUM record follows OP_END. Its two 1 byte parameters are the
+// lengths of the output and basis checksums that come after it. A basis
+// checksum length of 0 means the basis wasn't known.
+func writeChecksum(output io.Writer, sum, basisSum []byte) error {
+	if len(basisSum) > 0xff {
+		return fmt.Errorf("invalid basis checksum length %d", len(basisSum))
+	}
+
+	_, err := output.Write([]byte{byte(OP_CHECKSUM), byte(len(sum)), byte(len(basisSum))})
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(sum)
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(basisSum)
+	return err
+}
+
+// readChecksum reads what follows OP_END in delta, if anything, and checks it
+// against the checksum of the output and the basis.
+func readChecksum(delta io.Reader, sum []byte, base io.ReadSeeker) error {
+	expected, basisExpected, err := readTrailer(delta)
+	if err != nil {
+		return err
+	}
+
+	if len(basisExpected) > 0 {
+		if _, err := base.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		basisSum, err := WholeFileChecksum(base)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(basisSum, basisExpected) {
+			return ErrBasisChecksumMismatch
+		}
+	}
+
+	if expected != nil && !bytes.Equal(sum, expected) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// readTrailer reads the OP_CHECKSUM record after OP_END in delta. It returns
+// nil checksums if there is none.
+func readTrailer(delta io.Reader) (sum, basisSum []byte, err error) {
+	var op Op
+	err = binary.Read(delta, binary.BigEndian, &op)
+	if err == io.EOF {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := op2cmd[op]
+	if cmd.Kind != KIND_CHECKSUM {
+		return nil, nil, fmt.Errorf("Bogus command %x after end", cmd.Kind)
+	}
+
+	sum = make([]byte, readParam(delta, cmd.Len1))
+	basisSum = make([]byte, readParam(delta, cmd.Len2))
+	if _, err := io.ReadFull(delta, sum); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(delta, basisSum); err != nil {
+		return nil, nil, err
+	}
+	return sum, basisSum, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/resin-os/librsync-go"
+	"github.com/urfave/cli"
+)
+
+func CommandCompose(c *cli.Context) {
+	if len(c.Args()) > 3 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args())-3)
+	}
+
+	if c.Args().Get(0) == "" {
+		logrus.Fatalf("Missing first delta file")
+	}
+
+	if c.Args().Get(1) == "" {
+		logrus.Fatalf("Missing second delta file")
+	}
+
+	if c.Args().Get(2) == "" {
+		logrus.Fatalf("Missing delta file")
+	}
+
+	d1, err := os.Open(c.Args().Get(0))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer d1.Close()
+
+	d2, err := os.Open(c.Args().Get(1))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer d2.Close()
+
+	err = librsync.WriteFileAtomic(c.Args().Get(2), 0, func(delta *os.File) error {
+		output := bufio.NewWriter(delta)
+		if err := librsync.ComposeDeltas(bufio.NewReader(d1), bufio.NewReader(d2), output); err != nil {
+			return err
+		}
+		return output.Flush()
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
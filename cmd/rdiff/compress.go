@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/resin-os/librsync-go"
+)
+
+func parseCompression(name string) librsync.Compression {
+	switch name {
+	case "none":
+		return librsync.COMPRESSION_NONE
+	case "gzip":
+		return librsync.COMPRESSION_GZIP
+	case "zstd":
+		return librsync.COMPRESSION_ZSTD
+	case "xz":
+		return librsync.COMPRESSION_XZ
+	}
+	logrus.Fatalf("Invalid compression: %v", name)
+	return librsync.COMPRESSION_NONE
+}
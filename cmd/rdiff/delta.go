@@ -1,8 +1,56 @@
 package main
 
 import (
+	"bufio"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/resin-os/librsync-go"
 	"github.com/urfave/cli"
 )
 
 func CommandDelta(c *cli.Context) {
+	if len(c.Args()) > 3 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args())-3)
+	}
+
+	if c.Args().Get(0) == "" {
+		logrus.Fatalf("Missing signature file")
+	}
+
+	if c.Args().Get(1) == "" {
+		logrus.Fatalf("Missing newfile file")
+	}
+
+	if c.Args().Get(2) == "" {
+		logrus.Fatalf("Missing delta file")
+	}
+
+	opts := librsync.DeltaOptions{Compression: parseCompression(c.String("compress"))}
+
+	sig := readSignature(c.Args().Get(0))
+
+	newfile, err := os.Open(c.Args().Get(1))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer newfile.Close()
+
+	err = librsync.WriteFileAtomic(c.Args().Get(2), 0, func(delta *os.File) error {
+		output := bufio.NewWriter(delta)
+		compressed, err := librsync.CompressWriter(output, parseCompression(c.String("compress-output")))
+		if err != nil {
+			return err
+		}
+		if err := librsync.DeltaWithOptions(sig, newfile, compressed, &opts); err != nil {
+			return err
+		}
+		if err := compressed.Close(); err != nil {
+			return err
+		}
+		return output.Flush()
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
 }
@@ -35,7 +35,21 @@ func main() {
 				cli.StringFlag{
 					Name:  "hash, H",
 					Value: "blake2",
-					Usage: "Hash algorithm: blake2, md4",
+					Usage: "Hash algorithm: blake2, blake2-keyed, md4",
+				},
+				cli.StringFlag{
+					Name:  "rollsum, R",
+					Value: "rollsum",
+					Usage: "Rolling checksum algorithm: rollsum, rabinkarp",
+				},
+				cli.BoolFlag{
+					Name:  "cdc",
+					Usage: "Use content-defined chunks averaging block-size bytes (blake2 only)",
+				},
+				cli.StringFlag{
+					Name:  "compress-output",
+					Value: "none",
+					Usage: "Compress the signature file: none, gzip, zstd, xz",
 				},
 			},
 		},
@@ -44,12 +58,62 @@ func main() {
 			Usage:   "calculates the binary diff between old and new files",
 			ArgsUsage: "SIGNATURE NEWFILE DELTA",
 			Action:  CommandDelta,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "compress",
+					Value: "none",
+					Usage: "Compress literal data: none, gzip, zstd",
+				},
+				cli.StringFlag{
+					Name:  "compress-output",
+					Value: "none",
+					Usage: "Compress the whole delta file: none, gzip, zstd, xz",
+				},
+			},
 		},
 		{
 			Name:    "patch",
 			Usage:   "uses the delta file and old file to produce the new file",
 			ArgsUsage: "BASIS DELTA NEWFILE",
 			Action:  CommandPatch,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "in-place",
+					Usage: "Patch BASIS itself instead of writing NEWFILE, resumable through BASIS.journal if interrupted",
+				},
+				cli.StringFlag{
+					Name:  "range",
+					Usage: "Only write LENGTH bytes from OFFSET of the new file, given as OFFSET:LENGTH",
+				},
+				cli.BoolFlag{
+					Name:  "sparse",
+					Usage: "Leave out blocks of zeros from NEWFILE, making it sparse",
+				},
+			},
+		},
+		{
+			Name:      "verify",
+			Usage:     "checks whether a file matches a signature and lists the blocks that differ",
+			ArgsUsage: "SIGNATURE FILE",
+			Action:    CommandVerify,
+		},
+		{
+			Name:      "sigdiff",
+			Usage:     "compares two signatures and lists the blocks that were added, removed, changed or moved",
+			ArgsUsage: "OLDSIGNATURE NEWSIGNATURE",
+			Action:    CommandSigdiff,
+		},
+		{
+			Name:      "compose",
+			Usage:     "merges the deltas from old to intermediate and intermediate to new files into one from old to new",
+			ArgsUsage: "DELTA1 DELTA2 DELTA",
+			Action:    CommandCompose,
+		},
+		{
+			Name:      "reverse",
+			Usage:     "uses the delta file and old file to produce the delta from the new file back to the old one",
+			ArgsUsage: "BASIS DELTA REVERSEDELTA",
+			Action:    CommandReverse,
 		},
 	}
 
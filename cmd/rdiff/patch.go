@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+	"strconv"
+	"strings"
 	_ "io/ioutil"
 
 	"github.com/Sirupsen/logrus"
@@ -21,29 +23,91 @@ func CommandPatch(c *cli.Context) {
 	if c.Args().Get(1) == "" {
 		logrus.Fatalf("Missing delta file")
 	}
+
+	if c.Bool("in-place") {
+		patchInPlace(c.Args().Get(0), c.Args().Get(1))
+		return
+	}
+
 	if c.Args().Get(2) == "" {
 		logrus.Fatalf("Missing newfile file")
 	}
 
-	basis, err := os.Open(c.Args().Get(0))
+	if c.String("range") != "" {
+		patchRange(c.Args().Get(0), c.Args().Get(1), c.Args().Get(2), c.String("range"))
+		return
+	}
+
+	opts := librsync.PatchFileOptions{Sparse: c.Bool("sparse")}
+	if err := librsync.PatchFile(c.Args().Get(0), c.Args().Get(1), c.Args().Get(2), &opts); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func patchRange(basisPath, deltaPath, newPath, r string) {
+	off, length := parseRange(r)
+
+	basis, err := os.Open(basisPath)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 	defer basis.Close()
 
-	delta, err := os.Open(c.Args().Get(1))
+	delta, err := os.Open(deltaPath)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 	defer delta.Close()
 
-	newfile, err := os.OpenFile(c.Args().Get(2), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0600))
+	err = librsync.WriteFileAtomic(newPath, 0, func(newfile *os.File) error {
+		return librsync.PatchRange(basis, delta, off, length, newfile)
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func parseRange(s string) (int64, int64) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		logrus.Fatalf("Invalid range: %v", s)
+	}
+	off, err := strconv.ParseInt(parts[0], 0, 64)
+	if err != nil {
+		logrus.Fatalf("Invalid range offset: %v", err)
+	}
+	length, err := strconv.ParseInt(parts[1], 0, 64)
 	if err != nil {
+		logrus.Fatalf("Invalid range length: %v", err)
+	}
+	return off, length
+}
+
+func patchInPlace(basisPath, deltaPath string) {
+	basis, err := os.OpenFile(basisPath, os.O_RDWR, 0)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer basis.Close()
+
+	delta, err := os.Open(deltaPath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer delta.Close()
+
+	journalPath := basisPath + ".journal"
+	journal, err := os.OpenFile(journalPath, os.O_CREATE|os.O_RDWR, os.FileMode(0600))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer journal.Close()
+
+	if err := librsync.PatchInPlace(basis, delta, journal); err != nil {
 		logrus.Fatal(err)
 	}
-	defer newfile.Close()
 
-	if err := librsync.Patch(basis, delta, newfile); err != nil {
+	if err := os.Remove(journalPath); err != nil {
 		logrus.Fatal(err)
 	}
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/resin-os/librsync-go"
+	"github.com/urfave/cli"
+)
+
+func CommandReverse(c *cli.Context) {
+	if len(c.Args()) > 3 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args())-3)
+	}
+
+	if c.Args().Get(0) == "" {
+		logrus.Fatalf("Missing basis file")
+	}
+
+	if c.Args().Get(1) == "" {
+		logrus.Fatalf("Missing delta file")
+	}
+
+	if c.Args().Get(2) == "" {
+		logrus.Fatalf("Missing reverse delta file")
+	}
+
+	basis, err := os.Open(c.Args().Get(0))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer basis.Close()
+
+	delta, err := os.Open(c.Args().Get(1))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer delta.Close()
+
+	err = librsync.WriteFileAtomic(c.Args().Get(2), 0, func(reverse *os.File) error {
+		output := bufio.NewWriter(reverse)
+		if err := librsync.ReverseDelta(basis, bufio.NewReader(delta), output); err != nil {
+			return err
+		}
+		return output.Flush()
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/resin-os/librsync-go"
+	"github.com/urfave/cli"
+)
+
+func readSignature(path string) *librsync.SignatureType {
+	file, err := os.Open(path)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer file.Close()
+
+	sig, err := librsync.ReadSignature(bufio.NewReader(file))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return sig
+}
+
+func CommandSigdiff(c *cli.Context) {
+	if len(c.Args()) > 2 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args())-2)
+	}
+
+	if c.Args().Get(0) == "" {
+		logrus.Fatalf("Missing old signature file")
+	}
+
+	if c.Args().Get(1) == "" {
+		logrus.Fatalf("Missing new signature file")
+	}
+
+	diff, err := librsync.DiffSignatures(readSignature(c.Args().Get(0)), readSignature(c.Args().Get(1)))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if diff.Empty() {
+		fmt.Println("OK")
+		return
+	}
+
+	for _, idx := range diff.Added {
+		fmt.Printf("added %d\n", idx)
+	}
+	for _, idx := range diff.Removed {
+		fmt.Printf("removed %d\n", idx)
+	}
+	for _, idx := range diff.Changed {
+		fmt.Printf("changed %d\n", idx)
+	}
+	for _, m := range diff.Moved {
+		fmt.Printf("moved %d -> %d\n", m.From, m.To)
+	}
+	logrus.Fatalf("signatures differ")
+}
@@ -24,13 +24,36 @@ func CommandSignature(c *cli.Context) {
 
 	var sigType librsync.MagicNumber
 
-	switch c.String("hash") {
-	case "blake2":
-		sigType = librsync.BLAKE2_SIG_MAGIC
-	case "md4":
-		sigType = librsync.MD4_SIG_MAGIC
+	switch c.String("rollsum") {
+	case "rollsum":
+		switch c.String("hash") {
+		case "blake2":
+			sigType = librsync.BLAKE2_SIG_MAGIC
+		case "blake2-keyed":
+			sigType = librsync.KEYED_BLAKE2_SIG_MAGIC
+		case "md4":
+			sigType = librsync.MD4_SIG_MAGIC
+		default:
+			logrus.Fatalf("Invalid hash type: %v", c.String("hash"))
+		}
+	case "rabinkarp":
+		switch c.String("hash") {
+		case "blake2":
+			sigType = librsync.RK_BLAKE2_SIG_MAGIC
+		case "md4":
+			sigType = librsync.RK_MD4_SIG_MAGIC
+		default:
+			logrus.Fatalf("Invalid hash type for rabinkarp: %v", c.String("hash"))
+		}
 	default:
-		logrus.Fatalf("Invalid hash type: %v", c.String("hash"))
+		logrus.Fatalf("Invalid rollsum type: %v", c.String("rollsum"))
+	}
+
+	if c.Bool("cdc") {
+		if c.String("hash") != "blake2" {
+			logrus.Fatalf("Invalid hash type for cdc: %v", c.String("hash"))
+		}
+		sigType = librsync.CDC_BLAKE2_SIG_MAGIC
 	}
 
 	basis, err := os.Open(c.Args().Get(0))
@@ -39,13 +62,19 @@ func CommandSignature(c *cli.Context) {
 	}
 	defer basis.Close()
 
-	signature, err := os.OpenFile(c.Args().Get(1), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0600))
-	if err != nil {
-		logrus.Fatal(err)
-	}
-	defer signature.Close()
+	err = librsync.WriteFileAtomic(c.Args().Get(1), 0, func(signature *os.File) error {
+		output, err := librsync.CompressWriter(signature, parseCompression(c.String("compress-output")))
+		if err != nil {
+			return err
+		}
+
+		_, err = librsync.Signature(basis, output, uint32(c.Uint("block-size")), uint32(c.Uint("sum-size")), sigType)
+		if err != nil {
+			return err
+		}
 
-	_, err = librsync.Signature(basis, signature, uint32(c.Uint("block-size")), uint32(c.Uint("sum-size")), sigType)
+		return output.Close()
+	})
 	if err != nil {
 		logrus.Fatal(err)
 	}
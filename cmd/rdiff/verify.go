@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/resin-os/librsync-go"
+	"github.com/urfave/cli"
+)
+
+func CommandVerify(c *cli.Context) {
+	if len(c.Args()) > 2 {
+		logrus.Warnf("%d additional arguments passed are ignored", len(c.Args())-2)
+	}
+
+	if c.Args().Get(0) == "" {
+		logrus.Fatalf("Missing signature file")
+	}
+
+	if c.Args().Get(1) == "" {
+		logrus.Fatalf("Missing file to verify")
+	}
+
+	sig := readSignature(c.Args().Get(0))
+
+	file, err := os.Open(c.Args().Get(1))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer file.Close()
+
+	diff, err := librsync.Verify(sig, file)
+	if err != nil && err != librsync.ErrUnverifiedTail {
+		logrus.Fatal(err)
+	}
+
+	for _, idx := range diff {
+		fmt.Printf("block %d differs\n", idx)
+	}
+	if len(diff) > 0 {
+		logrus.Fatalf("%d blocks differ", len(diff))
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	fmt.Println("OK")
+}
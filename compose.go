@@ -0,0 +1,275 @@
+package librsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// segment is a piece of the output of a delta: the literal data lit, or at pos
+// of the delta if lit is nil, a copy from pos of the basis or a self copy from
+// pos of the output itself, which repeats if it overlaps the segment.
+type segment struct {
+	kind   matchKind
+	start  uint64
+	length uint64
+	pos    uint64
+	lit    []byte
+}
+
+// segmentMap maps the output of a delta to where its pieces come from.
+type segmentMap struct {
+	segs []segment
+	size uint64
+	// Header and checksums recorded in the delta, if any
+	header        *DeltaHeader
+	checksum      []byte
+	basisChecksum []byte
+}
+
+func (s *segmentMap) add(kind matchKind, pos, length uint64, lit []byte) error {
+	if length == 0 {
+		return nil
+	}
+	if s.size+length < s.size {
+		return fmt.Errorf("delta output overflows at %d bytes", s.size)
+	}
+
+	switch kind {
+	case MATCH_KIND_COPY:
+		// Coalesce copies of consecutive data
+		if n := len(s.segs); n > 0 {
+			prev := &s.segs[n-1]
+			if prev.kind == MATCH_KIND_COPY && prev.pos+prev.length == pos {
+				prev.length += length
+				s.size += length
+				return nil
+			}
+		}
+		lit = nil
+	case MATCH_KIND_SELF:
+		if pos >= s.size {
+			return fmt.Errorf("self copy from %d beyond output of %d bytes", pos, s.size)
+		}
+		lit = nil
+	}
+
+	s.segs = append(s.segs, segment{kind: kind, start: s.size, length: length, pos: pos, lit: lit})
+	s.size += length
+	return nil
+}
+
+// find returns the index of the segment pos is in.
+func (s *segmentMap) find(pos uint64) int {
+	return sort.Search(len(s.segs), func(i int) bool {
+		return s.segs[i].start+s.segs[i].length > pos
+	})
+}
+
+// resolve calls fn with the literal data and copies from the basis that make
+// up length bytes from pos of the output, which must all exist already.
+// Literal data left in the delta is passed as its offset there and nil lit.
+func (s *segmentMap) resolve(pos, length uint64, fn func(kind matchKind, pos, length uint64, lit []byte) error) error {
+	return s.walk(pos, length, fn, nil)
+}
+
+// mapInto appends length bytes from pos of the output to ret like resolve,
+// except that a self copy that repeats is mapped for one repetition and then
+// repeated by a self copy in ret, so that it doesn't turn into a segment per
+// repetition.
+func (s *segmentMap) mapInto(ret *segmentMap, pos, length uint64) error {
+	return s.walk(pos, length, ret.add, func(period, length uint64) error {
+		return ret.add(MATCH_KIND_SELF, ret.size-period, length, nil)
+	})
+}
+
+// walkItem is a part of the output left for walk to follow. If period is set,
+// it is length bytes that repeat every period bytes from pos, starting phase
+// bytes in, or with tail set the rest of them after the first repetition.
+type walkItem struct {
+	pos, length   uint64
+	period, phase uint64
+	tail          bool
+}
+
+// walk implements resolve and mapInto, which pass repeat. Self copies can
+// refer to other self copies any number of times over, so they are followed
+// with a stack of what is left to do rather than by recursing.
+func (s *segmentMap) walk(pos, length uint64, fn func(kind matchKind, pos, length uint64, lit []byte) error, repeat func(period, length uint64) error) error {
+	if pos+length > s.size || pos+length < pos {
+		return fmt.Errorf("copy from %d beyond output of %d bytes", pos, s.size)
+	}
+
+	stack := []walkItem{{pos: pos, length: length}}
+	for len(stack) > 0 {
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if it.tail {
+			if err := repeat(it.period, it.length); err != nil {
+				return err
+			}
+			continue
+		}
+		if it.period > 0 {
+			// One repetition at a time
+			o := it.phase % it.period
+			n := it.period - o
+			if n > it.length {
+				n = it.length
+			}
+			if n < it.length {
+				stack = append(stack, walkItem{pos: it.pos, length: it.length - n, period: it.period, phase: it.phase + n})
+			}
+			stack = append(stack, walkItem{pos: it.pos + o, length: n})
+			continue
+		}
+
+		for i := s.find(it.pos); it.length > 0; i++ {
+			seg := &s.segs[i]
+			off := it.pos - seg.start
+			n := seg.length - off
+			if n > it.length {
+				n = it.length
+			}
+			it.pos += n
+			it.length -= n
+
+			var err error
+			switch seg.kind {
+			case MATCH_KIND_LITERAL:
+				if seg.lit == nil {
+					err = fn(MATCH_KIND_LITERAL, seg.pos+off, n, nil)
+					break
+				}
+				err = fn(MATCH_KIND_LITERAL, 0, n, seg.lit[off:off+n])
+			case MATCH_KIND_COPY:
+				err = fn(MATCH_KIND_COPY, seg.pos+off, n, nil)
+			case MATCH_KIND_SELF:
+				// Follow the self copy, then the rest of the item
+				if it.length > 0 {
+					stack = append(stack, it)
+				}
+				d := seg.start - seg.pos
+				if repeat != nil && n > d {
+					stack = append(stack, walkItem{length: n - d, period: d, tail: true})
+					n = d
+				}
+				stack = append(stack, walkItem{pos: seg.pos, length: n, period: d, phase: off})
+				it.length = 0
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readSegments decodes delta into a map of its output. If basis is given it
+// is the map of the file delta applies to, which copies are mapped through.
+// Self copies are kept as such, resolve follows them.
+func readSegments(delta io.Reader, basis *segmentMap) (*segmentMap, error) {
+	d, err := newDeltaReader(delta)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.segments(basis)
+}
+
+// segments reads the rest of the delta like readSegments.
+func (d *deltaReader) segments(basis *segmentMap) (*segmentMap, error) {
+	ret := segmentMap{header: d.header}
+	for {
+		kind, param1, param2, lit, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		default:
+			return nil, fmt.Errorf("Bogus command %x", kind)
+		case KIND_LITERAL:
+			if d.lazy {
+				if off, ok := d.literalOffset(lit); ok {
+					if err := d.skip(lit, param1); err != nil {
+						return nil, err
+					}
+					err = ret.add(MATCH_KIND_LITERAL, uint64(off), uint64(param1), nil)
+					break
+				}
+			}
+			// The length isn't trusted to allocate for, the data has to
+			// be there
+			var data bytes.Buffer
+			if _, err := io.CopyN(&data, lit, param1); err != nil {
+				return nil, err
+			}
+			err = ret.add(MATCH_KIND_LITERAL, 0, uint64(param1), data.Bytes())
+		case KIND_COPY:
+			if basis == nil {
+				err = ret.add(MATCH_KIND_COPY, uint64(param1), uint64(param2), nil)
+			} else {
+				err = basis.mapInto(&ret, uint64(param1), uint64(param2))
+			}
+		case KIND_SELF_COPY:
+			err = ret.add(MATCH_KIND_SELF, uint64(param1), uint64(param2), nil)
+		case KIND_END:
+			if h := d.header; h != nil && h.TargetLen >= 0 && ret.size != uint64(h.TargetLen) {
+				return nil, fmt.Errorf("output is %d bytes rather than expected %d", ret.size, h.TargetLen)
+			}
+			ret.checksum, ret.basisChecksum, err = readTrailer(d.r)
+			if err != nil {
+				return nil, err
+			}
+			return &ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ComposeDeltas writes a standard delta from A to C given d1 from A to B and
+// d2 from B to C, so that devices that skipped B don't have to produce it.
+// The copies of d2 are rewritten into the copies from A and literal data of
+// d1 they cover. All literal data of both deltas is held in memory.
+func ComposeDeltas(d1, d2 io.Reader, out io.Writer) error {
+	mid, err := readSegments(d1, nil)
+	if err != nil {
+		return err
+	}
+	target, err := readSegments(d2, mid)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(out, binary.BigEndian, DELTA_MAGIC)
+	if err != nil {
+		return err
+	}
+
+	m := match{output: out}
+	err = target.resolve(0, target.size, func(kind matchKind, pos, length uint64, lit []byte) error {
+		if kind == MATCH_KIND_COPY {
+			return m.add(MATCH_KIND_COPY, pos, length)
+		}
+		for _, b := range lit {
+			if err := m.add(MATCH_KIND_LITERAL, uint64(b), 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := m.flush(); err != nil {
+		return err
+	}
+
+	return binary.Write(out, binary.BigEndian, OP_END)
+}
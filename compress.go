@@ -0,0 +1,212 @@
+package librsync
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression selects how literal data in deltas, see DeltaOptions, or whole
+// files, see CompressWriter, are compressed.
+type Compression uint8
+
+const (
+	COMPRESSION_NONE Compression = iota
+	COMPRESSION_GZIP
+	COMPRESSION_ZSTD
+	// Only for whole files, literal data can't be compressed with xz
+	COMPRESSION_XZ
+)
+
+// Literal runs are compressed in pieces of at most this size, which bounds the
+// memory Patch needs to decode them. Shorter runs than compressMinLen are
+// hardly worth it and are left alone.
+const (
+	compressMaxLen = 1 << 20
+	compressMinLen = 64
+)
+
+func (c Compression) String() string {
+	switch c {
+	case COMPRESSION_NONE:
+		return "none"
+	case COMPRESSION_GZIP:
+		return "gzip"
+	case COMPRESSION_ZSTD:
+		return "zstd"
+	case COMPRESSION_XZ:
+		return "xz"
+	}
+	return fmt.Sprintf("Compression(%d)", uint8(c))
+}
+
+// literalCodec compresses and decompresses the data of OP_ZLITERAL ops, each
+// of which is a complete gzip stream or zstd frame.
+type literalCodec struct {
+	compression Compression
+	zenc        *zstd.Encoder
+	zdec        *zstd.Decoder
+}
+
+func newLiteralCodec(compression Compression) (*literalCodec, error) {
+	c := literalCodec{compression: compression}
+
+	var err error
+	switch compression {
+	case COMPRESSION_GZIP:
+	case COMPRESSION_ZSTD:
+		c.zenc, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		c.zdec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(compressMaxLen))
+	default:
+		err = fmt.Errorf("invalid compression %v", compression)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *literalCodec) compress(lit []byte) ([]byte, error) {
+	if c.compression == COMPRESSION_ZSTD {
+		return c.zenc.EncodeAll(lit, nil), nil
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(lit); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress decodes data, which must hold exactly size bytes of literal data.
+func (c *literalCodec) decompress(data []byte, size int64) ([]byte, error) {
+	var lit []byte
+	var err error
+
+	if c.compression == COMPRESSION_ZSTD {
+		lit, err = c.zdec.DecodeAll(data, make([]byte, 0, size))
+	} else {
+		var r *gzip.Reader
+		r, err = gzip.NewReader(bytes.NewReader(data))
+		if err == nil {
+			lit, err = io.ReadAll(io.LimitReader(r, size+1))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(lit)) != size {
+		return nil, fmt.Errorf("compressed literal is %d bytes rather than expected %d", len(lit), size)
+	}
+	return lit, nil
+}
+
+// readLiteral reads the data of an OP_ZLITERAL op with the given parameters
+// from delta and decompresses it.
+func (c *literalCodec) readLiteral(delta io.Reader, zlen, size int64) ([]byte, error) {
+	if zlen > compressMaxLen {
+		return nil, fmt.Errorf("compressed literal data of %d bytes exceeds %d", zlen, compressMaxLen)
+	}
+	if size > compressMaxLen {
+		return nil, fmt.Errorf("compressed literal of %d bytes exceeds %d", size, compressMaxLen)
+	}
+
+	z := make([]byte, zlen)
+	if _, err := io.ReadFull(delta, z); err != nil {
+		return nil, err
+	}
+	return c.decompress(z, size)
+}
+
+// Close releases the resources of the codec.
+func (c *literalCodec) Close() {
+	if c.zenc != nil {
+		c.zenc.Close()
+	}
+	if c.zdec != nil {
+		c.zdec.Close()
+	}
+}
+
+// CompressWriter returns a writer that compresses what is written to it into
+// w. It has to be closed to complete the output.
+func CompressWriter(w io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case COMPRESSION_NONE:
+		return nopWriteCloser{w}, nil
+	case COMPRESSION_GZIP:
+		return gzip.NewWriter(w), nil
+	case COMPRESSION_ZSTD:
+		return zstd.NewWriter(w)
+	case COMPRESSION_XZ:
+		return xz.NewWriter(w)
+	}
+	return nil, fmt.Errorf("invalid compression %v", compression)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+var compressionMagics = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{COMPRESSION_GZIP, []byte{0x1f, 0x8b}},
+	{COMPRESSION_ZSTD, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{COMPRESSION_XZ, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// DecompressReader returns a reader of the decompressed contents of r if it
+// starts with the magic number of a gzip, zstd or xz stream and of r as is
+// otherwise. Patch and ReadSignature use it, so they accept compressed deltas
+// and signatures.
+func DecompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	switch sniffCompression(br) {
+	case COMPRESSION_GZIP:
+		return gzip.NewReader(br)
+	case COMPRESSION_ZSTD:
+		d, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case COMPRESSION_XZ:
+		x, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(x), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+// sniffCompression returns the compression of the stream br starts with.
+func sniffCompression(br *bufio.Reader) Compression {
+	head, _ := br.Peek(6)
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.compression
+		}
+	}
+	return COMPRESSION_NONE
+}
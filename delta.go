@@ -4,25 +4,162 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash"
 	"io"
 
 	"github.com/resin-os/circbuf"
+	"golang.org/x/crypto/blake2b"
 )
 
+// DeltaOptions enables extensions of the delta format. The zero value writes
+// the same plain librsync delta as Delta.
+type DeltaOptions struct {
+	// Checksum appends an OP_CHECKSUM record with the WholeFileChecksum of
+	// the new file after OP_END, which Patch verifies. Readers that stop at
+	// OP_END, like librsync, ignore it.
+	Checksum bool
+	// BasisChecksum is the WholeFileChecksum of the basis, if known. It is
+	// recorded in the OP_CHECKSUM record for Patch to verify as well.
+	BasisChecksum []byte
+	// Header makes the delta start with DELTA_EXT_MAGIC and this extended
+	// header, which Patch enforces. The signature parameters are filled in
+	// from sig and the input must be exactly TargetLen bytes, if given.
+	Header *DeltaHeader
+	// Basis is the file sig was made from. If given, candidate blocks are
+	// compared with it directly and every match is extended backwards and
+	// forwards byte by byte while the data agrees, so a change inside a
+	// block only costs the changed bytes as literal. With CDC signatures
+	// matches are only extended backwards.
+	Basis io.ReaderAt
+	// SelfCopy lets the delta copy data that repeats within the new file
+	// from the output already produced instead of sending it as literal
+	// again. It implies an extended Header. Not supported with CDC
+	// signatures.
+	SelfCopy bool
+	// Compression compresses literal data where that makes it smaller. It
+	// implies an extended Header.
+	Compression Compression
+	// Monotonic only lets copies start at or after the end of the previous
+	// one, so the delta reads the basis strictly forward and can be applied
+	// with PatchStream. Blocks found further back are sent as literal.
+	Monotonic bool
+	// Window, if not 0, keeps copies within that many bytes before the
+	// furthest point of the basis copied so far and self copies within that
+	// many bytes before the output position, so the delta can be applied
+	// with PatchWindow. It implies an extended Header.
+	Window uint64
+}
+
 func Delta(sig *SignatureType, i io.Reader, output io.Writer) error {
+	return DeltaWithOptions(sig, i, output, nil)
+}
+
+func DeltaWithOptions(sig *SignatureType, i io.Reader, output io.Writer, opts *DeltaOptions) error {
+	if opts == nil {
+		opts = &DeltaOptions{}
+	}
+
+	var checksum hash.Hash
+	if opts.Checksum {
+		checksum, _ = blake2b.New256(nil)
+		i = io.TeeReader(i, checksum)
+	}
+
+	header := opts.Header
+	if (opts.SelfCopy || opts.Compression != COMPRESSION_NONE || opts.Window > 0) && header == nil {
+		header = &DeltaHeader{TargetLen: -1, BasisLen: -1}
+	}
+
+	var counter *countWriter
+	if header != nil {
+		counter = &countWriter{w: io.Discard, limit: -1}
+		i = io.TeeReader(i, counter)
+	}
+
 	input := bufio.NewReader(i)
 
-	err := binary.Write(output, binary.BigEndian, DELTA_MAGIC)
+	m := match{output: output, monotonic: opts.Monotonic, window: opts.Window}
+	if opts.SelfCopy {
+		if sig.sigType == CDC_BLAKE2_SIG_MAGIC {
+			return fmt.Errorf("self copies aren't supported with sigType %#x", sig.sigType)
+		}
+		self, err := newSelfIndex(sig)
+		if err != nil {
+			return err
+		}
+		self.latest = opts.Window > 0
+		m.self = self
+	}
+	if opts.Compression != COMPRESSION_NONE {
+		codec, err := newLiteralCodec(opts.Compression)
+		if err != nil {
+			return err
+		}
+		defer codec.Close()
+		m.codec = codec
+	}
+
+	var err error
+	if header != nil {
+		h := *header
+		h.SigType = sig.sigType
+		h.BlockLen = sig.blockLen
+		h.StrongLen = sig.strongLen
+		if opts.SelfCopy {
+			h.Flags |= DELTA_FLAG_SELF_COPY
+		}
+		h.Compression = opts.Compression
+		h.Window = opts.Window
+		err = writeDeltaHeader(output, &h)
+	} else {
+		err = binary.Write(output, binary.BigEndian, DELTA_MAGIC)
+	}
+	if err != nil {
+		return err
+	}
+
+	if sig.sigType == CDC_BLAKE2_SIG_MAGIC {
+		err = deltaCDC(sig, input, &m, opts.Basis)
+	} else {
+		err = deltaBlocks(sig, input, &m, opts.Basis)
+	}
 	if err != nil {
 		return err
 	}
 
+	if err := m.flush(); err != nil {
+		return err
+	}
+
+	if counter != nil && header.TargetLen >= 0 && counter.n != header.TargetLen {
+		return fmt.Errorf("input is %d bytes rather than expected %d", counter.n, header.TargetLen)
+	}
+
+	err = binary.Write(output, binary.BigEndian, OP_END)
+	if err != nil {
+		return err
+	}
+
+	if checksum != nil {
+		return writeChecksum(output, checksum.Sum(nil), opts.BasisChecksum)
+	}
+	return nil
+}
+
+// deltaBlocks feeds the ops needed to recreate input from the blocks of sig
+// into m, leaving it to the caller to flush them. If the basis is given,
+// candidate blocks are compared with it rather than by strong sum and every
+// match is extended byte by byte, see extendMatch.
+func deltaBlocks(sig *SignatureType, input *bufio.Reader, m *match, basis io.ReaderAt) error {
 	prevByte := byte(0)
-	m := match{output: output}
 
-	weakSum := NewRollsum()
+	weakSum, err := NewRollingHash(sig.sigType)
+	if err != nil {
+		return err
+	}
+	count := uint64(0)
 	block, _ := circbuf.NewBuffer(int64(sig.blockLen))
-	block.WriteByte(0)
 	pos := 0
 
 	for {
@@ -42,25 +179,60 @@ func Delta(sig *SignatureType, i io.Reader, output io.Writer) error {
 		}
 		block.WriteByte(in)
 		weakSum.Rollin(in)
+		count += 1
 
-		if weakSum.count < uint64(sig.blockLen) {
+		if count < uint64(sig.blockLen) {
 			continue
 		}
 
-		if weakSum.count > uint64(sig.blockLen) {
+		if count > uint64(sig.blockLen) {
 			err := m.add(MATCH_KIND_LITERAL, uint64(prevByte), 1)
 			if err != nil {
 				return err
 			}
 			weakSum.Rollout(prevByte)
+			count -= 1
+		}
+
+		if blockIdx, ok := sig.weak2block[weakSum.Digest()]; ok && sig.blockOffset(blockIdx) >= m.copyFloor() {
+			var matched bool
+			if basis != nil {
+				matched, err = basisEqual(basis, sig.blockOffset(blockIdx), block.Bytes())
+				if err != nil {
+					return err
+				}
+			} else {
+				strong2, _ := sig.strongSum(block.Bytes())
+				matched = bytes.Equal(sig.strongSigs[blockIdx], strong2)
+			}
+
+			if matched {
+				weakSum.Reset()
+				count = 0
+				block.Reset()
+
+				copyPos, copyLen := sig.blockOffset(blockIdx), uint64(sig.blockLen)
+				if basis != nil {
+					copyPos, copyLen, err = extendMatch(basis, input, m, copyPos, copyLen)
+					if err != nil {
+						return err
+					}
+				}
+				err := m.add(MATCH_KIND_COPY, copyPos, copyLen)
+				if err != nil {
+					return err
+				}
+				continue
+			}
 		}
 
-		if blockIdx, ok := sig.weak2block[weakSum.Digest()]; ok {
-			strong2, _ := CalcStrongSum(block.Bytes(), sig.sigType, sig.strongLen)
-			if bytes.Equal(sig.strongSigs[blockIdx], strong2) {
+		if m.self != nil {
+			if selfPos, ok := m.self.find(weakSum.Digest(), block.Bytes()); ok && selfPos >= m.selfFloor() {
 				weakSum.Reset()
+				count = 0
 				block.Reset()
-				err := m.add(MATCH_KIND_COPY, uint64(blockIdx)*uint64(sig.blockLen), uint64(sig.blockLen))
+
+				err := m.add(MATCH_KIND_SELF, selfPos, uint64(sig.blockLen))
 				if err != nil {
 					return err
 				}
@@ -75,9 +247,5 @@ func Delta(sig *SignatureType, i io.Reader, output io.Writer) error {
 		}
 	}
 
-	if err := m.flush(); err != nil {
-		return err
-	}
-
-	return binary.Write(output, binary.BigEndian, OP_END)
+	return nil
 }
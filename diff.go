@@ -0,0 +1,186 @@
+package librsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// Blocks indexed by DiffFiles start at this size and double until the basis
+// has no more than diffMaxBlocks of them.
+const (
+	diffMinBlockLen = 16
+	diffMaxBlocks   = 1 << 22
+)
+
+// DiffFiles writes a standard delta that recreates new from old when both are
+// at hand, skipping the signature. old is indexed in small blocks and every
+// match is checked against it and extended byte by byte in both directions,
+// so unaligned matches that a signature based delta misses are found too.
+func DiffFiles(old io.ReaderAt, new io.Reader, out io.Writer) error {
+	size, err := readerAtSize(old)
+	if err != nil {
+		return err
+	}
+
+	blockLen := uint32(diffMinBlockLen)
+	for size/int64(blockLen) > diffMaxBlocks {
+		blockLen *= 2
+	}
+
+	sig, err := indexBasis(old, size, blockLen)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(out, binary.BigEndian, DELTA_MAGIC)
+	if err != nil {
+		return err
+	}
+
+	m := match{output: out}
+	if err := deltaBlocks(sig, bufio.NewReader(new), &m, old); err != nil {
+		return err
+	}
+	if err := m.flush(); err != nil {
+		return err
+	}
+
+	return binary.Write(out, binary.BigEndian, OP_END)
+}
+
+// indexBasis returns an in-memory signature with only the weak sums of the
+// blockLen sized blocks of base, keeping the first block for each sum.
+func indexBasis(base io.ReaderAt, size int64, blockLen uint32) (*SignatureType, error) {
+	sig := SignatureType{
+		sigType:    RK_BLAKE2_SIG_MAGIC,
+		blockLen:   blockLen,
+		weak2block: make(map[uint32]int),
+	}
+
+	weakSum, err := NewRollingHash(sig.sigType)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(base, 0, size))
+	block := make([]byte, blockLen)
+	for idx := 0; ; idx++ {
+		if _, err := io.ReadFull(r, block); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		weakSum.Reset()
+		weakSum.Update(block)
+		if _, ok := sig.weak2block[weakSum.Digest()]; !ok {
+			sig.weak2block[weakSum.Digest()] = idx
+		}
+	}
+
+	return &sig, nil
+}
+
+// readerAtSize finds the size of r, reading it through if it can't tell.
+func readerAtSize(r io.ReaderAt) (int64, error) {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size(), nil
+	case interface{ Stat() (os.FileInfo, error) }:
+		info, err := r.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+	return io.Copy(io.Discard, io.NewSectionReader(r, 0, 1<<63-1))
+}
+
+// basisEqual reports whether base holds p at pos.
+func basisEqual(base io.ReaderAt, pos uint64, p []byte) (bool, error) {
+	buf := make([]byte, len(p))
+	n, err := base.ReadAt(buf, int64(pos))
+	if n < len(buf) {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(buf, p), nil
+}
+
+// extendMatch grows a copy of len bytes from pos of base, which input has just
+// matched, in both directions and returns the grown copy.
+func extendMatch(base io.ReaderAt, input *bufio.Reader, m *match, pos, len uint64) (uint64, uint64, error) {
+	pos, len, err := extendBackward(base, m, pos, len)
+	if err != nil {
+		return 0, 0, err
+	}
+	return extendForward(base, input, pos, len)
+}
+
+// extendBackward takes over the tail of the pending literal in m as far as
+// base has the same bytes before pos.
+func extendBackward(base io.ReaderAt, m *match, pos, len uint64) (uint64, uint64, error) {
+	var buf [256]byte
+
+	floor := m.copyFloor()
+	for m.kind == MATCH_KIND_LITERAL && m.len > 0 && pos > floor {
+		n := uint64(cap(buf))
+		if n > pos-floor {
+			n = pos - floor
+		}
+		if n > m.len {
+			n = m.len
+		}
+		if _, err := base.ReadAt(buf[:n], int64(pos-n)); err != nil {
+			return 0, 0, err
+		}
+
+		lit := m.lit[m.len-n:]
+		k := uint64(0)
+		for k < n && buf[n-1-k] == lit[n-1-k] {
+			k++
+		}
+		m.retract(k)
+		pos -= k
+		len += k
+		if k < n {
+			break
+		}
+	}
+
+	return pos, len, nil
+}
+
+// extendForward consumes input for as long as it follows base after the copy.
+func extendForward(base io.ReaderAt, input *bufio.Reader, pos, len uint64) (uint64, uint64, error) {
+	var buf [256]byte
+
+	for {
+		n, err := base.ReadAt(buf[:], int64(pos+len))
+		if err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+
+		for _, b := range buf[:n] {
+			in, err := input.ReadByte()
+			if err == io.EOF {
+				return pos, len, nil
+			} else if err != nil {
+				return 0, 0, err
+			}
+			if in != b {
+				return pos, len, input.UnreadByte()
+			}
+			len++
+		}
+
+		if err == io.EOF || n == 0 {
+			return pos, len, nil
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package librsync
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// PatchFileOptions are the options of PatchFile.
+type PatchFileOptions struct {
+	// If set, the whole file checksum the output must have, see
+	// WholeFileChecksum
+	Checksum []byte
+	// Permissions of the output. If 0, an existing output keeps its own
+	// and a new one gets those of the basis.
+	Mode os.FileMode
+	// Write the output with PatchSparse
+	Sparse bool
+}
+
+// PatchFile applies the delta at deltaPath to the file at basePath and
+// replaces the file at outPath with the result atomically, see
+// WriteFileAtomic, so that it is never left half written.
+func PatchFile(basePath, deltaPath, outPath string, opts *PatchFileOptions) error {
+	if opts == nil {
+		opts = &PatchFileOptions{}
+	}
+
+	base, err := os.Open(basePath)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+
+	delta, err := os.Open(deltaPath)
+	if err != nil {
+		return err
+	}
+	defer delta.Close()
+
+	mode := opts.Mode
+	if _, err := os.Stat(outPath); mode == 0 && os.IsNotExist(err) {
+		info, err := base.Stat()
+		if err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+	}
+
+	return WriteFileAtomic(outPath, mode, func(out *os.File) error {
+		// out is a new file open for reading and writing, so self copies
+		// can read it back rather than keep the output in memory
+		var err error
+		if opts.Sparse {
+			err = patchSparse(base, delta, out, out)
+		} else {
+			err = patch(base, delta, out, out)
+		}
+		if err != nil {
+			return err
+		}
+
+		if opts.Checksum != nil {
+			sum, err := WholeFileChecksum(io.NewSectionReader(out, 0, 1<<63-1))
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(sum, opts.Checksum) {
+				return ErrChecksumMismatch
+			}
+		}
+		return nil
+	})
+}
+
+// WriteFileAtomic replaces the file at path with what write writes to the
+// file it is passed. That is a temporary file in the same directory, which is
+// synced and renamed to path only if write succeeds, so that path holds
+// either its old or its new contents even after a crash. The file gets the
+// permissions perm or, if perm is 0, keeps those of the file it replaces,
+// and a new one is only accessible to its owner.
+func WriteFileAtomic(path string, perm os.FileMode, write func(f *os.File) error) error {
+	if perm == 0 {
+		perm = 0600
+		if info, err := os.Stat(path); err == nil {
+			perm = info.Mode().Perm()
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	err = write(f)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	// Make the rename durable, where directories can be synced
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package librsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DeltaHeader is the extended header of DELTA_EXT_MAGIC deltas. It lets the
+// receiver preallocate the output, report progress and check it has the
+// right basis before patching. Lengths are -1 when unknown.
+type DeltaHeader struct {
+	TargetLen int64
+	BasisLen  int64
+	// WholeFileChecksum of the basis, empty if unknown
+	BasisChecksum []byte
+
+	// Parameters of the signature the delta was created from
+	SigType   MagicNumber
+	BlockLen  uint32
+	StrongLen uint32
+
+	// DELTA_FLAG_* extensions the delta uses, set by DeltaWithOptions
+	Flags uint32
+	// How the data of OP_ZLITERAL ops is compressed
+	Compression Compression
+	// DeltaOptions.Window the delta was created with, 0 if unbounded
+	Window uint64
+}
+
+const (
+	// The delta has OP_SELF_COPY ops, which copy from the output already
+	// produced, see DeltaOptions.SelfCopy.
+	DELTA_FLAG_SELF_COPY uint32 = 1 << iota
+)
+
+// Headers are far shorter, longer ones are rejected rather than allocated for.
+const maxDeltaHeaderLen = 64 * 1024
+
+// On the wire the header is a 4 byte length followed by that many bytes of
+// fields. Readers ignore any fields past the ones they know, so new ones can
+// be appended, but reject headers longer than maxDeltaHeaderLen.
+func writeDeltaHeader(output io.Writer, h *DeltaHeader) error {
+	if len(h.BasisChecksum) > 0xff {
+		return fmt.Errorf("invalid basis checksum length %d", len(h.BasisChecksum))
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, h.TargetLen)
+	binary.Write(&buf, binary.BigEndian, h.BasisLen)
+	buf.WriteByte(byte(len(h.BasisChecksum)))
+	buf.Write(h.BasisChecksum)
+	binary.Write(&buf, binary.BigEndian, h.SigType)
+	binary.Write(&buf, binary.BigEndian, h.BlockLen)
+	binary.Write(&buf, binary.BigEndian, h.StrongLen)
+	binary.Write(&buf, binary.BigEndian, h.Flags)
+	binary.Write(&buf, binary.BigEndian, h.Compression)
+	binary.Write(&buf, binary.BigEndian, h.Window)
+
+	err := binary.Write(output, binary.BigEndian, DELTA_EXT_MAGIC)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(output, binary.BigEndian, uint32(buf.Len()))
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(buf.Bytes())
+	return err
+}
+
+// ReadDeltaHeader reads the magic number and, for DELTA_EXT_MAGIC deltas, the
+// extended header from the start of delta. It returns a nil header for plain
+// deltas. delta has to be rewound before passing it to Patch.
+func ReadDeltaHeader(delta io.Reader) (*DeltaHeader, error) {
+	var magic MagicNumber
+
+	err := binary.Read(delta, binary.BigEndian, &magic)
+	if err != nil {
+		return nil, err
+	}
+
+	switch magic {
+	case DELTA_MAGIC:
+		return nil, nil
+	case DELTA_EXT_MAGIC:
+		return readDeltaHeader(delta)
+	}
+	return nil, fmt.Errorf("Got magic number %x rather than expected value %x", magic, DELTA_MAGIC)
+}
+
+func readDeltaHeader(delta io.Reader) (*DeltaHeader, error) {
+	var size uint32
+	err := binary.Read(delta, binary.BigEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > maxDeltaHeaderLen {
+		return nil, fmt.Errorf("delta header of %d bytes exceeds %d", size, maxDeltaHeaderLen)
+	}
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(delta, buf); err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(buf)
+
+	var h DeltaHeader
+	var sumLen uint8
+	for _, field := range []interface{}{&h.TargetLen, &h.BasisLen, &sumLen} {
+		if err := binary.Read(r, binary.BigEndian, field); err != nil {
+			return nil, fmt.Errorf("truncated delta header: %v", err)
+		}
+	}
+	h.BasisChecksum = make([]byte, sumLen)
+	if _, err := io.ReadFull(r, h.BasisChecksum); err != nil {
+		return nil, fmt.Errorf("truncated delta header: %v", err)
+	}
+	for _, field := range []interface{}{&h.SigType, &h.BlockLen, &h.StrongLen} {
+		if err := binary.Read(r, binary.BigEndian, field); err != nil {
+			return nil, fmt.Errorf("truncated delta header: %v", err)
+		}
+	}
+	// Fields added later, headers without them use no extensions
+	for _, field := range []interface{}{&h.Flags, &h.Compression, &h.Window} {
+		if r.Len() == 0 {
+			break
+		}
+		if err := binary.Read(r, binary.BigEndian, field); err != nil {
+			return nil, fmt.Errorf("truncated delta header: %v", err)
+		}
+	}
+
+	return &h, nil
+}
+
+// checkBasis verifies base against the length and checksum in h, if known.
+func (h *DeltaHeader) checkBasis(base io.ReadSeeker) error {
+	if h.BasisLen >= 0 {
+		size, err := base.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if size != h.BasisLen {
+			return fmt.Errorf("basis is %d bytes rather than expected %d", size, h.BasisLen)
+		}
+	}
+
+	if len(h.BasisChecksum) > 0 {
+		if _, err := base.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		sum, err := WholeFileChecksum(base)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(sum, h.BasisChecksum) {
+			return ErrBasisChecksumMismatch
+		}
+	}
+
+	return nil
+}
+
+// checkBasisAt is checkBasis for a basis that is only read at offsets.
+func (h *DeltaHeader) checkBasisAt(base io.ReaderAt) error {
+	if h.BasisLen < 0 && len(h.BasisChecksum) == 0 {
+		return nil
+	}
+
+	size, err := readerAtSize(base)
+	if err != nil {
+		return err
+	}
+	return h.checkBasis(io.NewSectionReader(base, 0, size))
+}
+
+// countWriter counts the bytes written through it and fails once more than
+// limit were written, unless limit is negative.
+type countWriter struct {
+	w     io.Writer
+	n     int64
+	limit int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	if c.limit >= 0 && c.n+int64(len(p)) > c.limit {
+		return 0, fmt.Errorf("output exceeds target length %d", c.limit)
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
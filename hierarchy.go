@@ -0,0 +1,170 @@
+package librsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Two level signatures for large files with few changes. The basis side sends
+// a coarse signature with large blocks, the new side matches it and asks for
+// fine signatures of only the coarse blocks it didn't find, then produces a
+// standard delta from both:
+//
+//	coarse, _ := Signature(basis, coarseOut, 1<<20, 32, BLAKE2_SIG_MAGIC)
+//	h, _ := NewHierarchicalDelta(coarse, newFile)
+//	fine, _ := FineSignature(basis, coarse, h.Missing(), fineOut, 2048, 32, BLAKE2_SIG_MAGIC)
+//	h.Delta(fine, deltaOut)
+//
+// The coarse block length must be a multiple of the fine one.
+
+type coarseCopy struct {
+	newPos  uint64
+	basePos uint64
+	len     uint64
+}
+
+type HierarchicalDelta struct {
+	coarse  *SignatureType
+	input   io.ReadSeeker
+	size    uint64
+	copies  []coarseCopy
+	missing []int
+}
+
+// NewHierarchicalDelta matches input against the coarse signature. input is
+// read again by Delta, so it must stay open until then.
+func NewHierarchicalDelta(coarse *SignatureType, input io.ReadSeeker) (*HierarchicalDelta, error) {
+	if coarse.sigType == CDC_BLAKE2_SIG_MAGIC {
+		return nil, fmt.Errorf("invalid sigType %#x for hierarchical delta", coarse.sigType)
+	}
+
+	h := HierarchicalDelta{coarse: coarse, input: input}
+	used := make([]bool, len(coarse.strongSigs))
+
+	m := match{sink: func(kind matchKind, pos, len uint64, lit []byte) error {
+		if kind == MATCH_KIND_COPY {
+			h.copies = append(h.copies, coarseCopy{h.size, pos, len})
+			for off := pos; off < pos+len; off += uint64(coarse.blockLen) {
+				used[off/uint64(coarse.blockLen)] = true
+			}
+		}
+		h.size += len
+		return nil
+	}}
+
+	if err := deltaBlocks(coarse, bufio.NewReader(input), &m, nil); err != nil {
+		return nil, err
+	}
+	if err := m.flush(); err != nil {
+		return nil, err
+	}
+
+	for i, u := range used {
+		if !u {
+			h.missing = append(h.missing, i)
+		}
+	}
+
+	return &h, nil
+}
+
+// Missing returns the indexes of the coarse blocks that weren't found in the
+// new file, for which the basis side should send fine signatures.
+func (h *HierarchicalDelta) Missing() []int {
+	return h.missing
+}
+
+// FineSignature signs the coarse blocks of base listed in blocks with
+// blockLen sized blocks. The result is a regular signature of those coarse
+// blocks concatenated in order.
+func FineSignature(base io.ReaderAt, coarse *SignatureType, blocks []int, output io.Writer, blockLen, strongLen uint32, sigType MagicNumber) (*SignatureType, error) {
+	if blockLen == 0 || coarse.blockLen%blockLen != 0 {
+		return nil, fmt.Errorf("coarse blockLen %d is not a multiple of %d", coarse.blockLen, blockLen)
+	}
+
+	readers := make([]io.Reader, len(blocks))
+	for i, idx := range blocks {
+		readers[i] = io.NewSectionReader(base, int64(coarse.blockOffset(idx)), int64(coarse.blockLen))
+	}
+
+	return Signature(io.MultiReader(readers...), output, blockLen, strongLen, sigType)
+}
+
+// Delta writes a standard delta that copies the coarse blocks found by
+// NewHierarchicalDelta and matches the rest of the new file against fine,
+// which must be the FineSignature of the Missing blocks. If fine is nil the
+// rest is sent as literal data.
+func (h *HierarchicalDelta) Delta(fine *SignatureType, output io.Writer) error {
+	if fine != nil {
+		if fine.sigType == CDC_BLAKE2_SIG_MAGIC || fine.blockLen == 0 || h.coarse.blockLen%fine.blockLen != 0 {
+			return fmt.Errorf("fine signature doesn't match coarse blockLen %d", h.coarse.blockLen)
+		}
+
+		perBlock := int(h.coarse.blockLen / fine.blockLen)
+		if len(fine.strongSigs) != perBlock*len(h.missing) {
+			return fmt.Errorf("fine signature has %d blocks rather than expected %d", len(fine.strongSigs), perBlock*len(h.missing))
+		}
+
+		offsets := make([]uint64, len(fine.strongSigs))
+		for i := range offsets {
+			offsets[i] = h.coarse.blockOffset(h.missing[i/perBlock]) + uint64(i%perBlock)*uint64(fine.blockLen)
+		}
+		f := *fine
+		f.offsets = offsets
+		fine = &f
+	}
+
+	err := binary.Write(output, binary.BigEndian, DELTA_MAGIC)
+	if err != nil {
+		return err
+	}
+
+	m := match{output: output}
+	pos := uint64(0)
+
+	gap := func(end uint64) error {
+		if end == pos {
+			return nil
+		}
+		if _, err := h.input.Seek(int64(pos), io.SeekStart); err != nil {
+			return err
+		}
+		input := bufio.NewReader(io.LimitReader(h.input, int64(end-pos)))
+
+		if fine != nil {
+			return deltaBlocks(fine, input, &m, nil)
+		}
+		for {
+			b, err := input.ReadByte()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := m.add(MATCH_KIND_LITERAL, uint64(b), 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, c := range h.copies {
+		if err := gap(c.newPos); err != nil {
+			return err
+		}
+		if err := m.add(MATCH_KIND_COPY, c.basePos, c.len); err != nil {
+			return err
+		}
+		pos = c.newPos + c.len
+	}
+	if err := gap(h.size); err != nil {
+		return err
+	}
+
+	if err := m.flush(); err != nil {
+		return err
+	}
+
+	return binary.Write(output, binary.BigEndian, OP_END)
+}
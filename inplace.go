@@ -0,0 +1,595 @@
+package librsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// InPlaceFile is a file that can be patched in place, like *os.File.
+type InPlaceFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+}
+
+// In place patching copies data within the file, so a copy must not run after
+// another one overwrote what it reads. The copies are ordered so that every
+// copy runs before those that write over its source, as in "In-Place
+// Reconstruction of Delta Compressed Files" by Burns and Long. Where copies
+// depend on each other in a cycle, one of them is turned into literal data
+// read before the file is modified. Self copies run last, when what they copy
+// from is final.
+//
+// Copies run in pieces of inPlaceChunkLen, in the direction that never
+// overwrites the source of a later piece of the same copy. A piece can still
+// overwrite its own source if the copy moves data by less than that.
+//
+// The journal makes this crash safe. It holds the data of converted copies
+// and the number of steps done. Steps run in batches, after each of which the
+// file is synced and the number is updated, and after a crash the last batch
+// is redone. A batch therefore ends before a step that would overwrite what an
+// earlier step of it read. A piece that overwrites its own source is a batch
+// of its own, and its data is saved in the journal before it runs.
+//
+// The journal starts with a 4 byte magic number, the BLAKE2 hash of the delta,
+// the 8 byte number of steps done and the 8 byte length of the saved data that
+// follows it. The magic number is written last, so a journal without it
+// belongs to a patch that didn't start modifying the file yet. After the data
+// is the slot for the data of a piece, its 8 byte step number and length and
+// the BLAKE2 hash of all three, followed by the data.
+
+const inPlaceJournalMagic uint32 = 0x72730300
+
+const (
+	journalStepsOffset = 4 + blake2b.Size256
+	journalDataOffset  = journalStepsOffset + 16
+	journalSlotLen     = 16 + blake2b.Size256
+)
+
+const (
+	inPlaceChunkLen = 1 << 20
+	// Batches end after this many steps or bytes, if not before
+	inPlaceBatchSteps = 4096
+	inPlaceBatchLen   = 64 << 20
+)
+
+type inPlaceStepKind uint8
+
+const (
+	// A copy from src of the file
+	stepCopy inPlaceStepKind = iota
+	// The literal data lit, or at src of the delta if lit is nil
+	stepLiteral
+	// A copy from src converted to literal data, which is read beforehand
+	// into lit or, with a journal, saved at saved of its data
+	stepConverted
+	// A self copy of output that repeats every period bytes from src,
+	// starting phase bytes into it
+	stepSelf
+)
+
+// inPlaceStep writes len bytes at dst, of at most inPlaceChunkLen.
+type inPlaceStep struct {
+	kind          inPlaceStepKind
+	src, dst, len uint64
+	lit           []byte
+	saved         uint64
+	period, phase uint64
+}
+
+// overlaps reports whether s is a copy that overwrites its own source.
+func (s *inPlaceStep) overlaps() bool {
+	return s.kind == stepCopy && s.src < s.dst+s.len && s.dst < s.src+s.len
+}
+
+// PatchInPlace applies delta to file, replacing the basis with the result. If
+// journal is given it is used to resume an interrupted patch and is truncated
+// once the patch is complete; without it, an interruption leaves file
+// corrupted, and the data of copies that had to be converted to literal data
+// is held in memory. Literal data is read from delta as needed if it is an
+// uncompressed io.ReadSeeker, like a file, and held in memory otherwise.
+func PatchInPlace(file InPlaceFile, delta io.Reader, journal InPlaceFile) error {
+	deltaSum, _ := blake2b.New256(nil)
+	var target *segmentMap
+	var deltaAt io.ReaderAt
+	if rs, ok := delta.(io.ReadSeeker); ok {
+		// Hash the delta first, so that literal data can be left in it
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(deltaSum, rs); err != nil {
+			return err
+		}
+		if _, err := rs.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+
+		d, err := newDeltaReader(rs)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		d.lazy = true
+		if target, err = d.segments(nil); err != nil {
+			return err
+		}
+		deltaAt = seekReaderAt{rs}
+	} else {
+		var err error
+		target, err = readSegments(io.TeeReader(delta, deltaSum), nil)
+		if err != nil {
+			return err
+		}
+		// Include anything after the delta's checksum trailer in the hash
+		if _, err := io.Copy(deltaSum, delta); err != nil {
+			return err
+		}
+	}
+
+	steps := planInPlace(target)
+
+	var savedLen uint64
+	for i := range steps {
+		if steps[i].kind == stepConverted {
+			steps[i].saved = savedLen
+			savedLen += steps[i].len
+		}
+	}
+
+	done, ok, err := readJournal(journal, deltaSum.Sum(nil), savedLen)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		// The basis can't be checked once it was modified
+		if target.header != nil {
+			if err := target.header.checkBasisAt(file); err != nil {
+				return err
+			}
+		}
+		if len(target.basisChecksum) > 0 {
+			sum, err := WholeFileChecksum(io.NewSectionReader(file, 0, 1<<63-1))
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(sum, target.basisChecksum) {
+				return ErrBasisChecksumMismatch
+			}
+		}
+
+		if journal != nil {
+			err = writeJournal(journal, file, deltaSum.Sum(nil), steps, savedLen)
+		} else {
+			err = readConverted(file, steps)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := runInPlace(file, journal, deltaAt, steps, done, int64(journalDataOffset+savedLen)); err != nil {
+		return err
+	}
+
+	if err := file.Truncate(int64(target.size)); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	if target.checksum != nil {
+		sum, err := WholeFileChecksum(io.NewSectionReader(file, 0, int64(target.size)))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(sum, target.checksum) {
+			return ErrChecksumMismatch
+		}
+	}
+
+	if journal != nil {
+		if err := journal.Truncate(0); err != nil {
+			return err
+		}
+		return journal.Sync()
+	}
+	return nil
+}
+
+// seekReaderAt reads r at an offset by seeking to it, so it can only be used
+// by one reader at a time.
+type seekReaderAt struct {
+	r io.ReadSeeker
+}
+
+func (s seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.r, p)
+}
+
+// planInPlace orders the copies of target so that none overwrites the source
+// of a later one and splits them into pieces. Literal data, including copies
+// that had to be converted to it, follows them, and self copies come last.
+func planInPlace(target *segmentMap) []inPlaceStep {
+	var segs []segment
+	var literals, selfs []inPlaceStep
+	for _, seg := range target.segs {
+		switch seg.kind {
+		case MATCH_KIND_LITERAL:
+			for off := uint64(0); off < seg.length; off += inPlaceChunkLen {
+				s := inPlaceStep{kind: stepLiteral, dst: seg.start + off, len: chunkLen(seg.length - off)}
+				if seg.lit != nil {
+					s.lit = seg.lit[off : off+s.len]
+				} else {
+					s.src = seg.pos + off
+				}
+				literals = append(literals, s)
+			}
+		case MATCH_KIND_COPY:
+			if seg.pos != seg.start {
+				segs = append(segs, seg)
+			}
+		case MATCH_KIND_SELF:
+			for off := uint64(0); off < seg.length; off += inPlaceChunkLen {
+				selfs = append(selfs, inPlaceStep{kind: stepSelf, src: seg.pos, dst: seg.start + off, len: chunkLen(seg.length - off), period: seg.start - seg.pos, phase: off})
+			}
+		}
+	}
+
+	// u -> v if v writes over what u reads, so u has to run first. The copies
+	// are in output order, so their destinations are sorted.
+	deps := func(u int) []int {
+		var ret []int
+		from, to := segs[u].pos, segs[u].pos+segs[u].length
+		v := sort.Search(len(segs), func(i int) bool {
+			return segs[i].start+segs[i].length > from
+		})
+		for ; v < len(segs) && segs[v].start < to; v++ {
+			if v != u {
+				ret = append(ret, v)
+			}
+		}
+		return ret
+	}
+
+	const (
+		white = iota
+		gray
+		black
+	)
+	color := make([]int, len(segs))
+	converted := make([]bool, len(segs))
+	var order []int
+
+	var visit func(u int)
+	visit = func(u int) {
+		color[u] = gray
+		for _, v := range deps(u) {
+			if color[v] == gray {
+				// A cycle, converting u to a literal removes all of its
+				// dependencies
+				converted[u] = true
+				break
+			}
+			if color[v] == white {
+				visit(v)
+			}
+		}
+		color[u] = black
+		order = append(order, u)
+	}
+	for u := range segs {
+		if color[u] == white {
+			visit(u)
+		}
+	}
+
+	// Post order has every copy after those it has to precede
+	var steps []inPlaceStep
+	for i := len(order) - 1; i >= 0; i-- {
+		seg := segs[order[i]]
+		if converted[order[i]] {
+			for off := uint64(0); off < seg.length; off += inPlaceChunkLen {
+				literals = append(literals, inPlaceStep{kind: stepConverted, src: seg.pos + off, dst: seg.start + off, len: chunkLen(seg.length - off)})
+			}
+			continue
+		}
+		steps = append(steps, splitCopy(seg.pos, seg.start, seg.length)...)
+	}
+	steps = append(steps, literals...)
+	return append(steps, selfs...)
+}
+
+// chunkLen returns how much of n bytes fits in a step.
+func chunkLen(n uint64) uint64 {
+	if n > inPlaceChunkLen {
+		return inPlaceChunkLen
+	}
+	return n
+}
+
+// splitCopy splits a copy into pieces of at most inPlaceChunkLen, in an order
+// where none overwrites the source of a later one.
+func splitCopy(src, dst, length uint64) []inPlaceStep {
+	var steps []inPlaceStep
+	for off := uint64(0); off < length; off += inPlaceChunkLen {
+		n := chunkLen(length - off)
+		if src > dst {
+			steps = append(steps, inPlaceStep{src: src + off, dst: dst + off, len: n})
+		} else {
+			end := length - off
+			steps = append(steps, inPlaceStep{src: src + end - n, dst: dst + end - n, len: n})
+		}
+	}
+	return steps
+}
+
+// runInPlace runs steps from done on in batches, see above. delta is where
+// literal data left in the delta is read from.
+func runInPlace(file, journal InPlaceFile, delta io.ReaderAt, steps []inPlaceStep, done uint64, slotOffset int64) error {
+	buf := make([]byte, inPlaceChunkLen)
+
+	// What the steps of the batch read, and how much they wrote
+	var reads [][2]uint64
+	var written uint64
+	batch := done
+
+	commit := func(n uint64) error {
+		reads = reads[:0]
+		written = 0
+		batch = n
+		if journal == nil {
+			return nil
+		}
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		var count [8]byte
+		binary.BigEndian.PutUint64(count[:], n)
+		if _, err := journal.WriteAt(count[:], journalStepsOffset); err != nil {
+			return err
+		}
+		return journal.Sync()
+	}
+
+	// A piece that was interrupted after its data was saved
+	if journal != nil && done < uint64(len(steps)) {
+		saved, err := readSlot(journal, slotOffset, done)
+		if err != nil {
+			return err
+		}
+		if saved != nil {
+			if _, err := file.WriteAt(saved, int64(steps[done].dst)); err != nil {
+				return err
+			}
+			done++
+			if err := commit(done); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := done; i < uint64(len(steps)); i++ {
+		s := &steps[i]
+
+		if i > batch && (s.overlaps() || len(reads) >= inPlaceBatchSteps || written >= inPlaceBatchLen || overwritesRead(reads, s)) {
+			if err := commit(i); err != nil {
+				return err
+			}
+		}
+
+		if s.overlaps() && journal != nil {
+			p := buf[:s.len]
+			if _, err := file.ReadAt(p, int64(s.src)); err != nil {
+				return err
+			}
+			if err := writeSlot(journal, slotOffset, i, p); err != nil {
+				return err
+			}
+			if _, err := file.WriteAt(p, int64(s.dst)); err != nil {
+				return err
+			}
+			if err := commit(i + 1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := runStep(file, journal, delta, s, buf); err != nil {
+			return err
+		}
+		// Self copies only read final data, which no later step writes
+		if s.kind == stepCopy {
+			reads = append(reads, [2]uint64{s.src, s.src + s.len})
+		}
+		written += s.len
+	}
+
+	return commit(uint64(len(steps)))
+}
+
+// overwritesRead reports whether s writes over any of reads.
+func overwritesRead(reads [][2]uint64, s *inPlaceStep) bool {
+	for _, r := range reads {
+		if s.dst < r[1] && r[0] < s.dst+s.len {
+			return true
+		}
+	}
+	return false
+}
+
+func runStep(file, journal InPlaceFile, delta io.ReaderAt, s *inPlaceStep, buf []byte) error {
+	if s.lit != nil {
+		_, err := file.WriteAt(s.lit, int64(s.dst))
+		return err
+	}
+
+	p := buf[:s.len]
+	var err error
+	switch s.kind {
+	case stepCopy:
+		_, err = file.ReadAt(p, int64(s.src))
+	case stepLiteral:
+		_, err = delta.ReadAt(p, int64(s.src))
+	case stepConverted:
+		_, err = journal.ReadAt(p, int64(journalDataOffset+s.saved))
+	case stepSelf:
+		// Read up to one repetition and repeat it
+		for j := uint64(0); j < s.len && err == nil; {
+			if j >= s.period {
+				j += uint64(copy(p[j:], p[j-s.period:j]))
+				continue
+			}
+			o := (s.phase + j) % s.period
+			n := s.period - o
+			if n > s.len-j {
+				n = s.len - j
+			}
+			_, err = file.ReadAt(p[j:j+n], int64(s.src+o))
+			j += n
+		}
+	}
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(p, int64(s.dst))
+	return err
+}
+
+// readConverted reads the data of converted copies into memory, for patching
+// without a journal.
+func readConverted(file InPlaceFile, steps []inPlaceStep) error {
+	for i := range steps {
+		if steps[i].kind == stepConverted {
+			steps[i].lit = make([]byte, steps[i].len)
+			if _, err := file.ReadAt(steps[i].lit, int64(steps[i].src)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readJournal returns the number of steps done of an interrupted patch with
+// delta sum and savedLen bytes of data saved, and whether there is one.
+func readJournal(journal InPlaceFile, sum []byte, savedLen uint64) (uint64, bool, error) {
+	if journal == nil {
+		return 0, false, nil
+	}
+
+	var head [journalDataOffset]byte
+	if _, err := journal.ReadAt(head[:], 0); err == io.EOF {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	if binary.BigEndian.Uint32(head[:]) != inPlaceJournalMagic {
+		return 0, false, nil
+	}
+	if !bytes.Equal(head[4:journalStepsOffset], sum) {
+		return 0, false, fmt.Errorf("journal belongs to a different delta")
+	}
+	if n := binary.BigEndian.Uint64(head[journalStepsOffset+8:]); n != savedLen {
+		return 0, false, fmt.Errorf("journal holds %d bytes of data rather than expected %d", n, savedLen)
+	}
+	return binary.BigEndian.Uint64(head[journalStepsOffset:]), true, nil
+}
+
+// writeJournal starts the journal of a patch with delta sum, saving the data
+// of the converted copies among steps.
+func writeJournal(journal, file InPlaceFile, sum []byte, steps []inPlaceStep, savedLen uint64) error {
+	if err := journal.Truncate(0); err != nil {
+		return err
+	}
+
+	head := make([]byte, journalDataOffset)
+	copy(head[4:], sum)
+	binary.BigEndian.PutUint64(head[journalStepsOffset+8:], savedLen)
+	if _, err := journal.WriteAt(head, 0); err != nil {
+		return err
+	}
+
+	buf := make([]byte, inPlaceChunkLen)
+	for _, s := range steps {
+		if s.kind != stepConverted {
+			continue
+		}
+		p := buf[:s.len]
+		if _, err := file.ReadAt(p, int64(s.src)); err != nil {
+			return err
+		}
+		if _, err := journal.WriteAt(p, int64(journalDataOffset+s.saved)); err != nil {
+			return err
+		}
+	}
+	if err := journal.Sync(); err != nil {
+		return err
+	}
+
+	binary.BigEndian.PutUint32(head, inPlaceJournalMagic)
+	if _, err := journal.WriteAt(head[:4], 0); err != nil {
+		return err
+	}
+	return journal.Sync()
+}
+
+// slotSum returns the hash of a slot of the journal, over the header in head
+// and data.
+func slotSum(head []byte, data []byte) []byte {
+	h, _ := blake2b.New256(nil)
+	h.Write(head[:16])
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// writeSlot saves the data of step in the journal.
+func writeSlot(journal InPlaceFile, offset int64, step uint64, data []byte) error {
+	slot := make([]byte, journalSlotLen, journalSlotLen+len(data))
+	binary.BigEndian.PutUint64(slot, step)
+	binary.BigEndian.PutUint64(slot[8:], uint64(len(data)))
+	copy(slot[16:], slotSum(slot, data))
+
+	if _, err := journal.WriteAt(append(slot, data...), offset); err != nil {
+		return err
+	}
+	return journal.Sync()
+}
+
+// readSlot returns the data saved for step, or nil if there is none or it
+// wasn't saved completely.
+func readSlot(journal InPlaceFile, offset int64, step uint64) ([]byte, error) {
+	head := make([]byte, journalSlotLen)
+	if _, err := journal.ReadAt(head, offset); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint64(head[8:])
+	if binary.BigEndian.Uint64(head) != step || size > inPlaceChunkLen {
+		return nil, nil
+	}
+
+	data := make([]byte, size)
+	if _, err := journal.ReadAt(data, offset+journalSlotLen); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(slotSum(head, data), head[16:]) {
+		return nil, nil
+	}
+	return data, nil
+}
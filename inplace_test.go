@@ -0,0 +1,181 @@
+package librsync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var errCrashed = errors.New("crashed")
+
+// crashFile is an InPlaceFile in memory. Writes fail once crash, shared by
+// the files of a patch, counts down to 0, and lose loses what wasn't synced.
+type crashFile struct {
+	b, synced []byte
+	crash     *int
+}
+
+func (f *crashFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(f.b).ReadAt(p, off)
+}
+
+func (f *crashFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.crash != nil {
+		if *f.crash--; *f.crash == 0 {
+			return 0, errCrashed
+		}
+	}
+	if end := int(off) + len(p); end > len(f.b) {
+		f.b = append(f.b, make([]byte, end-len(f.b))...)
+	}
+	return copy(f.b[off:], p), nil
+}
+
+func (f *crashFile) Truncate(size int64) error {
+	if int(size) <= len(f.b) {
+		f.b = f.b[:size]
+	} else {
+		f.b = append(f.b, make([]byte, int(size)-len(f.b))...)
+	}
+	return nil
+}
+
+func (f *crashFile) Sync() error {
+	f.synced = append(f.synced[:0], f.b...)
+	return nil
+}
+
+func (f *crashFile) lose() {
+	f.b = append([]byte(nil), f.synced...)
+}
+
+func TestPlanInPlace(t *testing.T) {
+	old := make([]byte, 40)
+	for i := range old {
+		old[i] = byte(i)
+	}
+
+	for _, tc := range []struct {
+		name string
+		// Sources of the 10 byte blocks of the output
+		blocks    []uint64
+		converted int
+	}{
+		{"chain", []uint64{10, 20, 30, 30}, 0},
+		{"reverse chain", []uint64{0, 0, 10, 20}, 0},
+		{"cycle", []uint64{10, 20, 0, 30}, 1},
+		{"two cycles", []uint64{10, 0, 30, 20}, 2},
+	} {
+		var target segmentMap
+		var want []byte
+		for _, pos := range tc.blocks {
+			target.add(MATCH_KIND_COPY, pos, 10, nil)
+			want = append(want, old[pos:pos+10]...)
+		}
+
+		steps := planInPlace(&target)
+		converted := 0
+		for _, s := range steps {
+			if s.kind == stepConverted {
+				converted++
+			}
+		}
+		if converted != tc.converted {
+			t.Errorf("%s: %d copies converted rather than %d", tc.name, converted, tc.converted)
+		}
+
+		f := &crashFile{b: append([]byte(nil), old...)}
+		if err := readConverted(f, steps); err != nil {
+			t.Fatal(err)
+		}
+		if err := runInPlace(f, nil, nil, steps, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(f.b, want) {
+			t.Errorf("%s: got %v, want %v", tc.name, f.b, want)
+		}
+	}
+}
+
+func TestPatchInPlaceResume(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		p := make([]byte, n)
+		r.Read(p)
+		return p
+	}
+
+	old := random(64 * 1024)
+	added := random(3000)
+	var shuffled []byte
+	for _, i := range r.Perm(64) {
+		shuffled = append(shuffled, old[i*1024:(i+1)*1024]...)
+	}
+
+	for _, tc := range []struct {
+		name string
+		new  []byte
+		opts DeltaOptions
+	}{
+		{"shuffled", shuffled, DeltaOptions{}},
+		{"inserted", append(added[:7:7], old...), DeltaOptions{}},
+		{"removed", old[5000:], DeltaOptions{}},
+		// A copy that runs before one that overlaps its own source, in the
+		// same batch
+		{"moved", bytes.Join([][]byte{old[:900], old[1000:39000], added[:100], old[50000:51000], old[40000:]}, nil), DeltaOptions{}},
+		{"rotated", append(append([]byte(nil), old[300:]...), old[:300]...), DeltaOptions{}},
+		{"self copies", append(append(append([]byte(nil), old[:20000]...), added...), append(added, old[20000:]...)...), DeltaOptions{SelfCopy: true}},
+	} {
+		var sigBuf, delta bytes.Buffer
+		sig, err := Signature(bytes.NewReader(old), &sigBuf, 512, 32, BLAKE2_SIG_MAGIC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := tc.opts
+		opts.Basis = bytes.NewReader(old)
+		opts.Checksum = true
+		if err := DeltaWithOptions(sig, bytes.NewReader(tc.new), &delta, &opts); err != nil {
+			t.Fatal(err)
+		}
+
+		// Crash at every write of the file and journal in turn, losing
+		// what wasn't synced, and resume
+		for crash := 1; ; crash++ {
+			left := crash
+			f := &crashFile{b: append([]byte(nil), old...), crash: &left}
+			f.Sync()
+			j := &crashFile{crash: &left}
+			err := PatchInPlace(f, bytes.NewReader(delta.Bytes()), j)
+			if err == nil {
+				if !bytes.Equal(f.b, tc.new) || len(j.b) != 0 {
+					t.Fatalf("%s: wrong result without a crash", tc.name)
+				}
+				break
+			}
+			if err != errCrashed {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+
+			f.lose()
+			j.lose()
+			f.crash, j.crash = nil, nil
+			if err := PatchInPlace(f, bytes.NewReader(delta.Bytes()), j); err != nil {
+				t.Fatalf("%s: resuming after write %d: %v", tc.name, crash, err)
+			}
+			if !bytes.Equal(f.b, tc.new) {
+				t.Fatalf("%s: wrong result resuming after write %d", tc.name, crash)
+			}
+		}
+
+		// The same without a journal, from a delta that can't seek
+		f := &crashFile{b: append([]byte(nil), old...)}
+		if err := PatchInPlace(f, struct{ io.Reader }{bytes.NewReader(delta.Bytes())}, nil); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(f.b, tc.new) {
+			t.Fatalf("%s: wrong result without a journal", tc.name)
+		}
+	}
+}
@@ -11,6 +11,8 @@ type matchKind uint8
 const (
 	MATCH_KIND_LITERAL matchKind = iota
 	MATCH_KIND_COPY
+	// A copy from the output rather than the basis
+	MATCH_KIND_SELF
 )
 
 type match struct {
@@ -19,6 +21,20 @@ type match struct {
 	len    uint64
 	output io.Writer
 	lit    []byte
+	// If set, flushed ops are passed to sink instead of being encoded
+	sink func(kind matchKind, pos, len uint64, lit []byte) error
+	// Length of the output added so far, including the pending op
+	written uint64
+	// If set, literal data is indexed for MATCH_KIND_SELF matches
+	self *selfIndex
+	// If set, literal data is written compressed
+	codec *literalCodec
+	// If set, copies may only start where the previous one ended or later
+	monotonic bool
+	// If not 0, copies may only start this far before the furthest end of
+	// the previous ones, and self copies this far before the output position
+	window  uint64
+	copyEnd uint64
 }
 
 func intSize(d uint64) uint8 {
@@ -52,13 +68,21 @@ func (m *match) flush() error {
 	if m.len == 0 {
 		return nil
 	}
+
+	if m.sink != nil {
+		err := m.sink(m.kind, m.pos, m.len, m.lit)
+		m.lit = []byte{}
+		m.pos = 0
+		m.len = 0
+		return err
+	}
 	posSize := intSize(m.pos)
 	lenSize := intSize(m.len)
 
 	var cmd Op
 
 	switch m.kind {
-	case MATCH_KIND_COPY:
+	case MATCH_KIND_COPY, MATCH_KIND_SELF:
 		switch posSize {
 		case 1:
 			cmd = OP_COPY_N1_N1
@@ -69,6 +93,9 @@ func (m *match) flush() error {
 		case 8:
 			cmd = OP_COPY_N8_N1
 		}
+		if m.kind == MATCH_KIND_SELF {
+			cmd += OP_SELF_COPY_N1_N1 - OP_COPY_N1_N1
+		}
 
 		switch lenSize {
 		case 2:
@@ -92,34 +119,133 @@ func (m *match) flush() error {
 			return err
 		}
 	case MATCH_KIND_LITERAL:
+		var err error
+		if m.codec != nil && m.len >= compressMinLen {
+			err = m.writeCompressed(m.lit)
+		} else {
+			err = m.writeLiteral(m.lit)
+		}
+		if err != nil {
+			return err
+		}
+		m.lit = []byte{}
+	}
+	m.pos = 0
+	m.len = 0
+	return nil
+}
+
+func (m *match) writeLiteral(lit []byte) error {
+	lenSize := intSize(uint64(len(lit)))
+
+	var cmd Op
+	switch lenSize {
+	case 1:
 		cmd = OP_LITERAL_N1
-		switch lenSize {
-		case 1:
-			cmd = OP_LITERAL_N1
-		case 2:
-			cmd = OP_LITERAL_N2
-		case 4:
-			cmd = OP_LITERAL_N4
-		case 8:
-			cmd = OP_LITERAL_N8
+	case 2:
+		cmd = OP_LITERAL_N2
+	case 4:
+		cmd = OP_LITERAL_N4
+	case 8:
+		cmd = OP_LITERAL_N8
+	}
+
+	err := binary.Write(m.output, binary.BigEndian, cmd)
+	if err != nil {
+		return err
+	}
+	err = m.write(uint64(len(lit)), lenSize)
+	if err != nil {
+		return err
+	}
+	_, err = m.output.Write(lit)
+	return err
+}
+
+// writeCompressed writes lit as OP_ZLITERAL ops of up to compressMaxLen bytes
+// each, or as plain literal where compressing doesn't pay off.
+func (m *match) writeCompressed(lit []byte) error {
+	for len(lit) > 0 {
+		piece := lit
+		if len(piece) > compressMaxLen {
+			piece = piece[:compressMaxLen]
 		}
+		lit = lit[len(piece):]
 
-		err := binary.Write(m.output, binary.BigEndian, cmd)
+		z, err := m.codec.compress(piece)
 		if err != nil {
 			return err
 		}
-		err = m.write(m.len, lenSize)
+		if len(z) >= len(piece) {
+			if err := m.writeLiteral(piece); err != nil {
+				return err
+			}
+			continue
+		}
+
+		zSize := intSize(uint64(len(z)))
+		lenSize := intSize(uint64(len(piece)))
+		cmd := OP_ZLITERAL_N1_N1 + Op(4*sizeIndex(zSize)+sizeIndex(lenSize))
+
+		err = binary.Write(m.output, binary.BigEndian, cmd)
 		if err != nil {
 			return err
 		}
-		m.output.Write(m.lit)
-		m.lit = []byte{}
+		err = m.write(uint64(len(z)), zSize)
+		if err != nil {
+			return err
+		}
+		err = m.write(uint64(len(piece)), lenSize)
+		if err != nil {
+			return err
+		}
+		if _, err := m.output.Write(z); err != nil {
+			return err
+		}
 	}
-	m.pos = 0
-	m.len = 0
 	return nil
 }
 
+// sizeIndex maps the parameter sizes 1, 2, 4 and 8 to their place in the op
+// table.
+func sizeIndex(size uint8) int {
+	switch size {
+	case 2:
+		return 1
+	case 4:
+		return 2
+	case 8:
+		return 3
+	}
+	return 0
+}
+
+// copyFloor returns the lowest basis offset the next copy may start at.
+func (m *match) copyFloor() uint64 {
+	switch {
+	case m.monotonic:
+		return m.copyEnd
+	case m.window > 0 && m.copyEnd > m.window:
+		return m.copyEnd - m.window
+	}
+	return 0
+}
+
+// selfFloor returns the lowest output offset the next self copy may start at.
+func (m *match) selfFloor() uint64 {
+	if m.window > 0 && m.written > m.window {
+		return m.written - m.window
+	}
+	return 0
+}
+
+// retract drops the last n bytes of a pending literal.
+func (m *match) retract(n uint64) {
+	m.lit = m.lit[:uint64(len(m.lit))-n]
+	m.len -= n
+	m.written -= n
+}
+
 func (m *match) add(kind matchKind, pos, len uint64) error {
 	if len != 0 && m.kind != kind {
 		err := m.flush()
@@ -134,7 +260,7 @@ func (m *match) add(kind matchKind, pos, len uint64) error {
 	case MATCH_KIND_LITERAL:
 		m.lit = append(m.lit, byte(pos))
 		m.len += 1
-	case MATCH_KIND_COPY:
+	case MATCH_KIND_COPY, MATCH_KIND_SELF:
 		m.lit = []byte{}
 		if m.pos+m.len != pos {
 			err := m.flush()
@@ -147,5 +273,16 @@ func (m *match) add(kind matchKind, pos, len uint64) error {
 			m.len += len
 		}
 	}
+	if kind == MATCH_KIND_LITERAL {
+		m.written += 1
+		if m.self != nil && m.len%uint64(m.self.blockLen) == 0 {
+			m.self.add(m.written-uint64(m.self.blockLen), m.lit[m.len-uint64(m.self.blockLen):])
+		}
+	} else {
+		m.written += len
+	}
+	if kind == MATCH_KIND_COPY && pos+len > m.copyEnd {
+		m.copyEnd = pos + len
+	}
 	return nil
 }
@@ -10,6 +10,9 @@ const (
 	KIND_SIGNATURE
 	KIND_COPY
 	KIND_CHECKSUM
+	KIND_SELF_COPY
+	// Literal data compressed as in DeltaHeader.Compression
+	KIND_ZLITERAL
 	KIND_RESERVED
 )
 
@@ -106,39 +109,39 @@ const (
 	OP_COPY_N8_N2
 	OP_COPY_N8_N4
 	OP_COPY_N8_N8
-	OP_RESERVED_85
-	OP_RESERVED_86
-	OP_RESERVED_87
-	OP_RESERVED_88
-	OP_RESERVED_89
-	OP_RESERVED_90
-	OP_RESERVED_91
-	OP_RESERVED_92
-	OP_RESERVED_93
-	OP_RESERVED_94
-	OP_RESERVED_95
-	OP_RESERVED_96
-	OP_RESERVED_97
-	OP_RESERVED_98
-	OP_RESERVED_99
-	OP_RESERVED_100
-	OP_RESERVED_101
-	OP_RESERVED_102
-	OP_RESERVED_103
-	OP_RESERVED_104
-	OP_RESERVED_105
-	OP_RESERVED_106
-	OP_RESERVED_107
-	OP_RESERVED_108
-	OP_RESERVED_109
-	OP_RESERVED_110
-	OP_RESERVED_111
-	OP_RESERVED_112
-	OP_RESERVED_113
-	OP_RESERVED_114
-	OP_RESERVED_115
-	OP_RESERVED_116
-	OP_RESERVED_117
+	OP_CHECKSUM
+	OP_SELF_COPY_N1_N1
+	OP_SELF_COPY_N1_N2
+	OP_SELF_COPY_N1_N4
+	OP_SELF_COPY_N1_N8
+	OP_SELF_COPY_N2_N1
+	OP_SELF_COPY_N2_N2
+	OP_SELF_COPY_N2_N4
+	OP_SELF_COPY_N2_N8
+	OP_SELF_COPY_N4_N1
+	OP_SELF_COPY_N4_N2
+	OP_SELF_COPY_N4_N4
+	OP_SELF_COPY_N4_N8
+	OP_SELF_COPY_N8_N1
+	OP_SELF_COPY_N8_N2
+	OP_SELF_COPY_N8_N4
+	OP_SELF_COPY_N8_N8
+	OP_ZLITERAL_N1_N1
+	OP_ZLITERAL_N1_N2
+	OP_ZLITERAL_N1_N4
+	OP_ZLITERAL_N1_N8
+	OP_ZLITERAL_N2_N1
+	OP_ZLITERAL_N2_N2
+	OP_ZLITERAL_N2_N4
+	OP_ZLITERAL_N2_N8
+	OP_ZLITERAL_N4_N1
+	OP_ZLITERAL_N4_N2
+	OP_ZLITERAL_N4_N4
+	OP_ZLITERAL_N4_N8
+	OP_ZLITERAL_N8_N1
+	OP_ZLITERAL_N8_N2
+	OP_ZLITERAL_N8_N4
+	OP_ZLITERAL_N8_N8
 	OP_RESERVED_118
 	OP_RESERVED_119
 	OP_RESERVED_120
@@ -365,39 +368,39 @@ var op2cmd = []Command{
 	Command{KIND_COPY, 0, 8, 2},       /*     OP_COPY_N8_N2 = 0x52 */
 	Command{KIND_COPY, 0, 8, 4},       /*     OP_COPY_N8_N4 = 0x53 */
 	Command{KIND_COPY, 0, 8, 8},       /*     OP_COPY_N8_N8 = 0x54 */
-	Command{KIND_RESERVED, 85, 0, 0},  /*    OP_RESERVED_85 = 0x55 */
-	Command{KIND_RESERVED, 86, 0, 0},  /*    OP_RESERVED_86 = 0x56 */
-	Command{KIND_RESERVED, 87, 0, 0},  /*    OP_RESERVED_87 = 0x57 */
-	Command{KIND_RESERVED, 88, 0, 0},  /*    OP_RESERVED_88 = 0x58 */
-	Command{KIND_RESERVED, 89, 0, 0},  /*    OP_RESERVED_89 = 0x59 */
-	Command{KIND_RESERVED, 90, 0, 0},  /*    OP_RESERVED_90 = 0x5a */
-	Command{KIND_RESERVED, 91, 0, 0},  /*    OP_RESERVED_91 = 0x5b */
-	Command{KIND_RESERVED, 92, 0, 0},  /*    OP_RESERVED_92 = 0x5c */
-	Command{KIND_RESERVED, 93, 0, 0},  /*    OP_RESERVED_93 = 0x5d */
-	Command{KIND_RESERVED, 94, 0, 0},  /*    OP_RESERVED_94 = 0x5e */
-	Command{KIND_RESERVED, 95, 0, 0},  /*    OP_RESERVED_95 = 0x5f */
-	Command{KIND_RESERVED, 96, 0, 0},  /*    OP_RESERVED_96 = 0x60 */
-	Command{KIND_RESERVED, 97, 0, 0},  /*    OP_RESERVED_97 = 0x61 */
-	Command{KIND_RESERVED, 98, 0, 0},  /*    OP_RESERVED_98 = 0x62 */
-	Command{KIND_RESERVED, 99, 0, 0},  /*    OP_RESERVED_99 = 0x63 */
-	Command{KIND_RESERVED, 100, 0, 0}, /*   OP_RESERVED_100 = 0x64 */
-	Command{KIND_RESERVED, 101, 0, 0}, /*   OP_RESERVED_101 = 0x65 */
-	Command{KIND_RESERVED, 102, 0, 0}, /*   OP_RESERVED_102 = 0x66 */
-	Command{KIND_RESERVED, 103, 0, 0}, /*   OP_RESERVED_103 = 0x67 */
-	Command{KIND_RESERVED, 104, 0, 0}, /*   OP_RESERVED_104 = 0x68 */
-	Command{KIND_RESERVED, 105, 0, 0}, /*   OP_RESERVED_105 = 0x69 */
-	Command{KIND_RESERVED, 106, 0, 0}, /*   OP_RESERVED_106 = 0x6a */
-	Command{KIND_RESERVED, 107, 0, 0}, /*   OP_RESERVED_107 = 0x6b */
-	Command{KIND_RESERVED, 108, 0, 0}, /*   OP_RESERVED_108 = 0x6c */
-	Command{KIND_RESERVED, 109, 0, 0}, /*   OP_RESERVED_109 = 0x6d */
-	Command{KIND_RESERVED, 110, 0, 0}, /*   OP_RESERVED_110 = 0x6e */
-	Command{KIND_RESERVED, 111, 0, 0}, /*   OP_RESERVED_111 = 0x6f */
-	Command{KIND_RESERVED, 112, 0, 0}, /*   OP_RESERVED_112 = 0x70 */
-	Command{KIND_RESERVED, 113, 0, 0}, /*   OP_RESERVED_113 = 0x71 */
-	Command{KIND_RESERVED, 114, 0, 0}, /*   OP_RESERVED_114 = 0x72 */
-	Command{KIND_RESERVED, 115, 0, 0}, /*   OP_RESERVED_115 = 0x73 */
-	Command{KIND_RESERVED, 116, 0, 0}, /*   OP_RESERVED_116 = 0x74 */
-	Command{KIND_RESERVED, 117, 0, 0}, /*   OP_RESERVED_117 = 0x75 */
+	Command{KIND_CHECKSUM, 0, 1, 1},   /*       OP_CHECKSUM = 0x55 */
+	Command{KIND_SELF_COPY, 0, 1, 1},  /* OP_SELF_COPY_N1_N1 = 0x56 */
+	Command{KIND_SELF_COPY, 0, 1, 2},  /* OP_SELF_COPY_N1_N2 = 0x57 */
+	Command{KIND_SELF_COPY, 0, 1, 4},  /* OP_SELF_COPY_N1_N4 = 0x58 */
+	Command{KIND_SELF_COPY, 0, 1, 8},  /* OP_SELF_COPY_N1_N8 = 0x59 */
+	Command{KIND_SELF_COPY, 0, 2, 1},  /* OP_SELF_COPY_N2_N1 = 0x5a */
+	Command{KIND_SELF_COPY, 0, 2, 2},  /* OP_SELF_COPY_N2_N2 = 0x5b */
+	Command{KIND_SELF_COPY, 0, 2, 4},  /* OP_SELF_COPY_N2_N4 = 0x5c */
+	Command{KIND_SELF_COPY, 0, 2, 8},  /* OP_SELF_COPY_N2_N8 = 0x5d */
+	Command{KIND_SELF_COPY, 0, 4, 1},  /* OP_SELF_COPY_N4_N1 = 0x5e */
+	Command{KIND_SELF_COPY, 0, 4, 2},  /* OP_SELF_COPY_N4_N2 = 0x5f */
+	Command{KIND_SELF_COPY, 0, 4, 4},  /* OP_SELF_COPY_N4_N4 = 0x60 */
+	Command{KIND_SELF_COPY, 0, 4, 8},  /* OP_SELF_COPY_N4_N8 = 0x61 */
+	Command{KIND_SELF_COPY, 0, 8, 1},  /* OP_SELF_COPY_N8_N1 = 0x62 */
+	Command{KIND_SELF_COPY, 0, 8, 2},  /* OP_SELF_COPY_N8_N2 = 0x63 */
+	Command{KIND_SELF_COPY, 0, 8, 4},  /* OP_SELF_COPY_N8_N4 = 0x64 */
+	Command{KIND_SELF_COPY, 0, 8, 8},  /* OP_SELF_COPY_N8_N8 = 0x65 */
+	Command{KIND_ZLITERAL, 0, 1, 1},   /* OP_ZLITERAL_N1_N1 = 0x66 */
+	Command{KIND_ZLITERAL, 0, 1, 2},   /* OP_ZLITERAL_N1_N2 = 0x67 */
+	Command{KIND_ZLITERAL, 0, 1, 4},   /* OP_ZLITERAL_N1_N4 = 0x68 */
+	Command{KIND_ZLITERAL, 0, 1, 8},   /* OP_ZLITERAL_N1_N8 = 0x69 */
+	Command{KIND_ZLITERAL, 0, 2, 1},   /* OP_ZLITERAL_N2_N1 = 0x6a */
+	Command{KIND_ZLITERAL, 0, 2, 2},   /* OP_ZLITERAL_N2_N2 = 0x6b */
+	Command{KIND_ZLITERAL, 0, 2, 4},   /* OP_ZLITERAL_N2_N4 = 0x6c */
+	Command{KIND_ZLITERAL, 0, 2, 8},   /* OP_ZLITERAL_N2_N8 = 0x6d */
+	Command{KIND_ZLITERAL, 0, 4, 1},   /* OP_ZLITERAL_N4_N1 = 0x6e */
+	Command{KIND_ZLITERAL, 0, 4, 2},   /* OP_ZLITERAL_N4_N2 = 0x6f */
+	Command{KIND_ZLITERAL, 0, 4, 4},   /* OP_ZLITERAL_N4_N4 = 0x70 */
+	Command{KIND_ZLITERAL, 0, 4, 8},   /* OP_ZLITERAL_N4_N8 = 0x71 */
+	Command{KIND_ZLITERAL, 0, 8, 1},   /* OP_ZLITERAL_N8_N1 = 0x72 */
+	Command{KIND_ZLITERAL, 0, 8, 2},   /* OP_ZLITERAL_N8_N2 = 0x73 */
+	Command{KIND_ZLITERAL, 0, 8, 4},   /* OP_ZLITERAL_N8_N4 = 0x74 */
+	Command{KIND_ZLITERAL, 0, 8, 8},   /* OP_ZLITERAL_N8_N8 = 0x75 */
 	Command{KIND_RESERVED, 118, 0, 0}, /*   OP_RESERVED_118 = 0x76 */
 	Command{KIND_RESERVED, 119, 0, 0}, /*   OP_RESERVED_119 = 0x77 */
 	Command{KIND_RESERVED, 120, 0, 0}, /*   OP_RESERVED_120 = 0x78 */
@@ -1,9 +1,14 @@
 package librsync
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash"
 	"io"
+
+	"golang.org/x/crypto/blake2b"
 )
 
 type MagicNumber uint32
@@ -11,6 +16,10 @@ type MagicNumber uint32
 const (
 	DELTA_MAGIC MagicNumber = 0x72730236
 
+	// A delta with an extended header, see DeltaHeader. Not understood by
+	// librsync.
+	DELTA_EXT_MAGIC MagicNumber = 0x72730237
+
 	// A signature file with MD4 signatures.
 	//
 	// Backward compatible with librsync < 1.0, but strongly deprecated because
@@ -20,6 +29,25 @@ const (
 
 	// A signature file using the BLAKE2 hash. Supported from librsync 1.0.
 	BLAKE2_SIG_MAGIC MagicNumber = 0x72730137
+
+	// A signature file using the BLAKE2 hash keyed with a random per-signature
+	// key stored in the header. Without the key an attacker cannot craft
+	// blocks whose strong sums collide. Not understood by librsync.
+	KEYED_BLAKE2_SIG_MAGIC MagicNumber = 0x72730138
+
+	// A signature file with the RabinKarp rolling hash and MD4 hash. The
+	// rolling hash is better but MD4 is as deprecated as in MD4_SIG_MAGIC.
+	// Supported from librsync 2.2.
+	RK_MD4_SIG_MAGIC MagicNumber = 0x72730146
+
+	// A signature file with the RabinKarp rolling hash and BLAKE2 hash.
+	// Supported from librsync 2.2.
+	RK_BLAKE2_SIG_MAGIC MagicNumber = 0x72730147
+
+	// A signature file of content-defined chunks with BLAKE2 hashes. Instead
+	// of weak and strong sums of fixed size blocks it lists the offset,
+	// length and strong sum of every chunk. Not understood by librsync.
+	CDC_BLAKE2_SIG_MAGIC MagicNumber = 0x72730157
 )
 
 func readParam(r io.Reader, size uint8) int64 {
@@ -44,45 +72,244 @@ func readParam(r io.Reader, size uint8) int64 {
 	return 0
 }
 
-func Patch(base io.ReadSeeker, delta io.Reader, out io.Writer) error {
-	var magic MagicNumber
+// readOp decodes the next command from delta. For KIND_LITERAL param1 bytes
+// of literal data follow it in delta.
+func readOp(delta io.Reader) (cmd Command, param1, param2 int64, err error) {
+	var op Op
+	err = binary.Read(delta, binary.BigEndian, &op)
+	if err != nil {
+		return
+	}
+	cmd = op2cmd[op]
 
-	err := binary.Read(delta, binary.BigEndian, &magic)
+	if cmd.Len1 == 0 {
+		param1 = int64(cmd.Immediate)
+	} else {
+		param1 = readParam(delta, cmd.Len1)
+		param2 = readParam(delta, cmd.Len2)
+	}
+	return
+}
+
+// deltaReader decodes the ops of a delta, which may be compressed as a whole,
+// see DecompressReader.
+type deltaReader struct {
+	r      io.ReadCloser
+	header *DeltaHeader
+	codec  *literalCodec
+	// An uncompressed delta that can seek and the buffer r reads it through,
+	// for skip
+	seeker io.ReadSeeker
+	buf    *bufio.Reader
+	// If set, segments records where uncompressed literal data is in the
+	// delta instead of reading it
+	lazy bool
+}
+
+func newDeltaReader(delta io.Reader) (*deltaReader, error) {
+	var d deltaReader
+	if s, ok := delta.(io.ReadSeeker); ok {
+		// DecompressReader reads through the same buffer
+		d.buf = bufio.NewReader(s)
+		if sniffCompression(d.buf) == COMPRESSION_NONE {
+			d.seeker = s
+		}
+		delta = d.buf
+	}
+
+	r, err := DecompressReader(delta)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if magic != DELTA_MAGIC {
-		return fmt.Errorf("Got magic number %x rather than expected value %x", magic, DELTA_MAGIC)
+	header, err := ReadDeltaHeader(r)
+	if err != nil {
+		r.Close()
+		return nil, err
 	}
 
-	for {
-		var op Op
-		err := binary.Read(delta, binary.BigEndian, &op)
+	d.r, d.header = r, header
+	if header != nil && header.Compression != COMPRESSION_NONE {
+		d.codec, err = newLiteralCodec(header.Compression)
 		if err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return &d, nil
+}
+
+// next returns the next op of the delta. Literal data, compressed or not, is
+// returned as KIND_LITERAL with param1 bytes that have to be read from lit
+// before calling next again.
+func (d *deltaReader) next() (kind OpKind, param1, param2 int64, lit io.Reader, err error) {
+	var cmd Command
+	cmd, param1, param2, err = readOp(d.r)
+	if err != nil {
+		return
+	}
+	kind = cmd.Kind
+	if param1 < 0 || param2 < 0 {
+		err = fmt.Errorf("invalid parameters %d, %d of command %x", param1, param2, kind)
+		return
+	}
+
+	switch kind {
+	case KIND_LITERAL:
+		lit = io.LimitReader(d.r, param1)
+	case KIND_ZLITERAL:
+		if d.codec == nil {
+			err = fmt.Errorf("compressed literal in delta without compression")
+			return
+		}
+		var data []byte
+		data, err = d.codec.readLiteral(d.r, param1, param2)
+		kind, param1, param2, lit = KIND_LITERAL, param2, 0, bytes.NewReader(data)
+	case KIND_SELF_COPY:
+		if d.header == nil || d.header.Flags&DELTA_FLAG_SELF_COPY == 0 {
+			err = fmt.Errorf("self copy in delta without DELTA_FLAG_SELF_COPY")
+		}
+	}
+	return
+}
+
+// skip discards n bytes of the literal data lit returned by next, seeking in
+// the delta if it can.
+func (d *deltaReader) skip(lit io.Reader, n int64) error {
+	l, ok := lit.(*io.LimitedReader)
+	if !ok || l.R != d.r || d.seeker == nil || n > l.N {
+		_, err := io.CopyN(io.Discard, lit, n)
+		return err
+	}
+
+	if buffered := int64(d.buf.Buffered()); n > buffered {
+		if _, err := d.seeker.Seek(n-buffered, io.SeekCurrent); err != nil {
 			return err
 		}
-		cmd := op2cmd[op]
+		d.buf.Reset(d.seeker)
+	} else if _, err := d.buf.Discard(int(n)); err != nil {
+		return err
+	}
+	l.N -= n
+	return nil
+}
+
+// literalOffset returns where the literal data lit returned by next starts in
+// the delta, if it is uncompressed and the delta can seek.
+func (d *deltaReader) literalOffset(lit io.Reader) (int64, bool) {
+	l, ok := lit.(*io.LimitedReader)
+	if !ok || l.R != d.r || d.seeker == nil {
+		return 0, false
+	}
+	pos, err := d.seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+	return pos - int64(d.buf.Buffered()), true
+}
+
+func (d *deltaReader) Close() error {
+	if d.codec != nil {
+		d.codec.Close()
+	}
+	return d.r.Close()
+}
+
+// patchOutput wraps the output of Patch to count and checksum it and, for
+// deltas with self copies, read it back. Unless readBack is given, which reads
+// out from where patching started, the output is kept in memory in whole or,
+// with a window, in part.
+type patchOutput struct {
+	counter  *countWriter
+	checksum hash.Hash
+	written  io.ReaderAt
+}
 
-		var param1, param2 int64
+func newPatchOutput(out io.Writer, header *DeltaHeader, window int, readBack io.ReaderAt) *patchOutput {
+	var o patchOutput
 
-		if cmd.Len1 == 0 {
-			param1 = int64(cmd.Immediate)
+	if header != nil && header.Flags&DELTA_FLAG_SELF_COPY != 0 {
+		if readBack != nil {
+			o.written = readBack
+		} else if window > 0 {
+			r := &ring{buf: make([]byte, window)}
+			o.written = r
+			out = io.MultiWriter(out, r)
 		} else {
-			param1 = readParam(delta, cmd.Len1)
-			param2 = readParam(delta, cmd.Len2)
+			history := &outputHistory{}
+			o.written = history
+			out = io.MultiWriter(out, history)
+		}
+	}
+
+	o.checksum, _ = blake2b.New256(nil)
+	o.counter = &countWriter{w: io.MultiWriter(out, o.checksum), limit: -1}
+	if header != nil {
+		o.counter.limit = header.TargetLen
+	}
+	return &o
+}
+
+// checkLen checks the output length against the header, if any.
+func (o *patchOutput) checkLen(header *DeltaHeader) error {
+	if header != nil && header.TargetLen >= 0 && o.counter.n != header.TargetLen {
+		return fmt.Errorf("output is %d bytes rather than expected %d", o.counter.n, header.TargetLen)
+	}
+	return nil
+}
+
+// Patch applies delta to base and writes the result to out. Deltas with self
+// copies keep the whole output in memory to copy from.
+func Patch(base io.ReadSeeker, delta io.Reader, out io.Writer) error {
+	return patch(base, delta, out, nil)
+}
+
+// patch is Patch with self copies reading the output back from readBack, if
+// given, see newPatchOutput.
+func patch(base io.ReadSeeker, delta io.Reader, out io.Writer, readBack io.ReaderAt) error {
+	d, err := newDeltaReader(delta)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	header := d.header
+
+	if header != nil {
+		if err := header.checkBasis(base); err != nil {
+			return err
+		}
+	}
+
+	o := newPatchOutput(out, header, 0, readBack)
+	out = o.counter
+
+	for {
+		kind, param1, param2, lit, err := d.next()
+		if err != nil {
+			return err
 		}
 
-		switch cmd.Kind {
+		switch kind {
 		default:
-			return fmt.Errorf("Bogus command %x", cmd.Kind)
+			return fmt.Errorf("Bogus command %x", kind)
 		case KIND_LITERAL:
-			io.CopyN(out, delta, param1)
+			if _, err := io.CopyN(out, lit, param1); err != nil {
+				return err
+			}
 		case KIND_COPY:
 			base.Seek(param1, io.SeekStart)
-			io.CopyN(out, base, param2)
+			if _, err := io.CopyN(out, base, param2); err != nil {
+				return err
+			}
+		case KIND_SELF_COPY:
+			if err := selfCopy(out, o.written, o.counter.n, param1, param2); err != nil {
+				return err
+			}
 		case KIND_END:
-			return nil
+			if err := o.checkLen(header); err != nil {
+				return err
+			}
+			return readChecksum(d.r, o.checksum.Sum(nil), base)
 		}
 	}
 }
@@ -0,0 +1,105 @@
+package librsync
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// patchedReader reads the output of a delta from its basis and literal data.
+type patchedReader struct {
+	base   io.ReaderAt
+	target *segmentMap
+	// The delta, for literal data target leaves there
+	delta io.ReaderAt
+}
+
+// OpenPatched returns a reader of the file that applying delta to base
+// produces, and its size. The delta is indexed once and every read is served
+// from the parts of base and the literal data it covers, so the file is never
+// produced as a whole. Literal data is read from delta as needed, except for
+// compressed data, which is held in memory. As reads only see parts of the
+// files, checksums in the delta aren't verified, nor is base other than its
+// length if it can tell it, like *os.File.
+//
+// base may itself be returned by OpenPatched, to read through a chain of
+// deltas.
+func OpenPatched(base io.ReaderAt, delta io.ReaderAt) (io.ReaderAt, int64, error) {
+	d, err := newDeltaReader(io.NewSectionReader(delta, 0, 1<<63-1))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer d.Close()
+
+	d.lazy = true
+	target, err := d.segments(nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if h := target.header; h != nil && h.BasisLen >= 0 {
+		var size int64 = -1
+		switch base := base.(type) {
+		case interface{ Size() int64 }:
+			size = base.Size()
+		case interface{ Stat() (os.FileInfo, error) }:
+			info, err := base.Stat()
+			if err != nil {
+				return nil, 0, err
+			}
+			size = info.Size()
+		}
+		if size >= 0 && size != h.BasisLen {
+			return nil, 0, fmt.Errorf("basis is %d bytes rather than expected %d", size, h.BasisLen)
+		}
+	}
+
+	return &patchedReader{base: base, target: target, delta: delta}, int64(target.size), nil
+}
+
+// Size returns the size of the output, so that it can be checked when it is
+// the basis of another delta.
+func (r *patchedReader) Size() int64 {
+	return int64(r.target.size)
+}
+
+func (r *patchedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("read at negative offset %d", off)
+	}
+	if uint64(off) >= r.target.size {
+		return 0, io.EOF
+	}
+
+	var err error
+	if remaining := r.target.size - uint64(off); uint64(len(p)) > remaining {
+		p = p[:remaining]
+		err = io.EOF
+	}
+
+	n := 0
+	resolveErr := r.target.resolve(uint64(off), uint64(len(p)), func(kind matchKind, pos, length uint64, lit []byte) error {
+		src := r.base
+		if kind == MATCH_KIND_LITERAL {
+			if lit != nil {
+				n += copy(p[n:], lit)
+				return nil
+			}
+			src = r.delta
+		}
+
+		m, err := src.ReadAt(p[n:n+int(length)], int64(pos))
+		n += m
+		if m == int(length) {
+			return nil
+		}
+		if err == io.EOF || err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	})
+	if resolveErr != nil {
+		return n, resolveErr
+	}
+	return n, err
+}
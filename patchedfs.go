@@ -0,0 +1,257 @@
+package librsync
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PatchedFS is a read only fs.FS of files produced by applying deltas to a
+// basis, all of which are read from Source. The files are read through
+// OpenPatched, so they are never produced as a whole. The files of Source
+// have to implement io.ReaderAt, as those of os.DirFS do.
+type PatchedFS struct {
+	Source fs.FS
+	// Files maps the names of the files in the FS to where they come from.
+	// Directories are implied by the names.
+	Files map[string]PatchedFile
+}
+
+// PatchedFile is a file of a PatchedFS, produced by applying Deltas in order
+// to Base.
+type PatchedFile struct {
+	Base   string
+	Deltas []string
+}
+
+func (f *PatchedFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if pf, ok := f.Files[name]; ok {
+		file, err := f.openFile(name, pf)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return file, nil
+	}
+
+	entries := f.readDir(name)
+	if entries == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &patchedDir{info: dirInfo(path.Base(name)), entries: entries}, nil
+}
+
+func (f *PatchedFS) openFile(name string, pf PatchedFile) (fs.File, error) {
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+
+	open := func(name string) (io.ReaderAt, fs.FileInfo, error) {
+		file, err := f.Source.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, file)
+
+		ra, ok := file.(io.ReaderAt)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s doesn't support random access", name)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			return nil, nil, err
+		}
+		return ra, info, nil
+	}
+
+	r, info, err := open(pf.Base)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	size := info.Size()
+	modTime := info.ModTime()
+
+	for _, d := range pf.Deltas {
+		delta, info, err := open(d)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		r, size, err = OpenPatched(r, delta)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("%s: %v", d, err)
+		}
+		modTime = info.ModTime()
+	}
+
+	return &patchedFile{
+		SectionReader: io.NewSectionReader(r, 0, size),
+		info:          fileInfo{name: path.Base(name), size: size, modTime: modTime},
+		closers:       closers,
+	}, nil
+}
+
+// readDir returns the entries of directory name, or nil if there is none.
+func (f *PatchedFS) readDir(name string) []fs.DirEntry {
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+
+	seen := make(map[string]bool)
+	var entries []fs.DirEntry
+	for file := range f.Files {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		rest := file[len(prefix):]
+		child, _, isDir := strings.Cut(rest, "/")
+		if seen[child] {
+			continue
+		}
+		seen[child] = true
+		entries = append(entries, &patchedDirEntry{fsys: f, name: child, path: prefix + child, dir: isDir})
+	}
+	if entries == nil && name == "." {
+		entries = []fs.DirEntry{}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries
+}
+
+type patchedFile struct {
+	*io.SectionReader
+	info    fileInfo
+	closers []io.Closer
+}
+
+func (f *patchedFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *patchedFile) Close() error {
+	var err error
+	for _, c := range f.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type patchedDir struct {
+	info    fileInfo
+	entries []fs.DirEntry
+}
+
+func (d *patchedDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *patchedDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fmt.Errorf("is a directory")}
+}
+
+func (d *patchedDir) Close() error {
+	return nil
+}
+
+func (d *patchedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+type patchedDirEntry struct {
+	fsys *PatchedFS
+	name string
+	path string
+	dir  bool
+}
+
+func (e *patchedDirEntry) Name() string {
+	return e.name
+}
+
+func (e *patchedDirEntry) IsDir() bool {
+	return e.dir
+}
+
+func (e *patchedDirEntry) Type() fs.FileMode {
+	if e.dir {
+		return fs.ModeDir
+	}
+	return 0
+}
+
+// Info opens the file to find its size, which needs its deltas indexed.
+func (e *patchedDirEntry) Info() (fs.FileInfo, error) {
+	if e.dir {
+		return dirInfo(e.name), nil
+	}
+	return fs.Stat(e.fsys, e.path)
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func dirInfo(name string) fileInfo {
+	return fileInfo{name: name, mode: fs.ModeDir | 0555}
+}
+
+func (i fileInfo) Name() string {
+	return i.name
+}
+
+func (i fileInfo) Size() int64 {
+	return i.size
+}
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.mode == 0 {
+		return 0444
+	}
+	return i.mode
+}
+
+func (i fileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i fileInfo) IsDir() bool {
+	return i.mode.IsDir()
+}
+
+func (i fileInfo) Sys() interface{} {
+	return nil
+}
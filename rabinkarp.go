@@ -0,0 +1,72 @@
+package librsync
+
+// RabinKarp is the polynomial rolling hash used by librsync >= 2.2 signatures.
+// It distributes better than Rollsum, which makes weak sum collisions (and
+// hence wasted strong sum calculations) much rarer.
+type RabinKarp struct {
+	count uint64
+	hash  uint32
+	mult  uint32
+}
+
+const (
+	RABINKARP_SEED = 1
+	RABINKARP_MULT = 0x08104225
+	// Multiplicative inverse of RABINKARP_MULT modulo 2^32
+	RABINKARP_INVM = 0x98f009ad
+	// RABINKARP_MULT - 1, the seed's contribution to a rolled out byte
+	RABINKARP_ADJ = 0x08104224
+)
+
+func NewRabinKarp() RabinKarp {
+	return RabinKarp{hash: RABINKARP_SEED, mult: 1}
+}
+
+func rabinKarpPow(n uint64) uint32 {
+	ret := uint32(1)
+	m := uint32(RABINKARP_MULT)
+	for n > 0 {
+		if n&1 != 0 {
+			ret *= m
+		}
+		m *= m
+		n >>= 1
+	}
+	return ret
+}
+
+func (r *RabinKarp) Update(p []byte) {
+	hash := r.hash
+	for _, b := range p {
+		hash = hash*RABINKARP_MULT + uint32(b)
+	}
+	r.hash = hash
+	r.count += uint64(len(p))
+	r.mult *= rabinKarpPow(uint64(len(p)))
+}
+
+func (r *RabinKarp) Rotate(out, in byte) {
+	r.hash = r.hash*RABINKARP_MULT + uint32(in) - r.mult*(uint32(out)+RABINKARP_ADJ)
+}
+
+func (r *RabinKarp) Rollin(in byte) {
+	r.hash = r.hash*RABINKARP_MULT + uint32(in)
+	r.count += 1
+	r.mult *= RABINKARP_MULT
+}
+
+func (r *RabinKarp) Rollout(out byte) {
+	r.count -= 1
+	r.mult *= RABINKARP_INVM
+	r.hash -= r.mult * (uint32(out) + RABINKARP_ADJ)
+}
+
+func (r *RabinKarp) Digest() uint32 {
+	return r.hash
+}
+
+func (r *RabinKarp) Reset() {
+	r.count = 0
+	r.hash = RABINKARP_SEED
+	r.mult = 1
+}
@@ -0,0 +1,101 @@
+package librsync
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// PatchRange writes length bytes from off of the file that applying delta to
+// base produces to out. Ops outside the range are skipped, and the literal
+// data they carry is seeked over if delta is an uncompressed io.ReadSeeker.
+// Deltas with self copies may copy from anywhere before the range, so they
+// are read in full and their literal data is held in memory. As only part of
+// the output is produced, checksums aren't verified.
+func PatchRange(base io.ReaderAt, delta io.Reader, off, length int64, out io.Writer) error {
+	if off < 0 || length < 0 || length > math.MaxInt64-off {
+		return fmt.Errorf("invalid range %d+%d", off, length)
+	}
+
+	d, err := newDeltaReader(delta)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if d.header != nil && d.header.TargetLen >= 0 && off+length > d.header.TargetLen {
+		return fmt.Errorf("range %d+%d beyond output of %d bytes", off, length, d.header.TargetLen)
+	}
+
+	if d.header != nil && d.header.Flags&DELTA_FLAG_SELF_COPY != 0 {
+		target, err := d.segments(nil)
+		if err != nil {
+			return err
+		}
+		if uint64(off+length) > target.size {
+			return fmt.Errorf("range %d+%d beyond output of %d bytes", off, length, target.size)
+		}
+		r := &patchedReader{base: base, target: target}
+		_, err = io.Copy(out, io.NewSectionReader(r, off, length))
+		return err
+	}
+
+	end := off + length
+	var pos int64
+	for pos < end {
+		kind, param1, param2, lit, err := d.next()
+		if err != nil {
+			return err
+		}
+
+		var n int64
+		switch kind {
+		default:
+			return fmt.Errorf("Bogus command %x", kind)
+		case KIND_LITERAL:
+			n = param1
+		case KIND_COPY:
+			n = param2
+		case KIND_END:
+			return fmt.Errorf("range %d+%d beyond output of %d bytes", off, length, pos)
+		}
+
+		// The part of the op within the range
+		from, to := pos, pos+n
+		if from < off {
+			from = off
+		}
+		if to > end {
+			to = end
+		}
+		pos += n
+		if from >= to {
+			if kind == KIND_LITERAL {
+				if err := d.skip(lit, n); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		start := from - (pos - n)
+		if kind == KIND_COPY {
+			c, err := io.Copy(out, io.NewSectionReader(base, param1+start, to-from))
+			if err != nil {
+				return err
+			}
+			if c != to-from {
+				return io.ErrUnexpectedEOF
+			}
+			continue
+		}
+
+		if err := d.skip(lit, start); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(out, lit, to-from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
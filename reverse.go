@@ -0,0 +1,109 @@
+package librsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// ReverseDelta writes a delta that recreates base from the file produced by
+// patching base with delta, so that an update can be rolled back without the
+// old version at hand. Every part of base that delta copies becomes a copy
+// from the new file, the rest is literal data read from base. base is checked
+// against the header and basis checksum of delta, if any, first.
+func ReverseDelta(base io.ReaderAt, delta io.Reader, out io.Writer) error {
+	size, err := readerAtSize(base)
+	if err != nil {
+		return err
+	}
+
+	target, err := readSegments(delta, nil)
+	if err != nil {
+		return err
+	}
+
+	if target.header != nil {
+		if err := target.header.checkBasisAt(base); err != nil {
+			return err
+		}
+	}
+	if len(target.basisChecksum) > 0 {
+		sum, err := WholeFileChecksum(io.NewSectionReader(base, 0, size))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(sum, target.basisChecksum) {
+			return ErrBasisChecksumMismatch
+		}
+	}
+
+	// The copies of delta, as where their data is in the new file, sorted by
+	// where it is in base
+	var copies []segment
+	for _, seg := range target.segs {
+		if seg.kind == MATCH_KIND_COPY {
+			copies = append(copies, seg)
+		}
+	}
+	sort.SliceStable(copies, func(i, j int) bool {
+		return copies[i].pos < copies[j].pos
+	})
+
+	err = binary.Write(out, binary.BigEndian, DELTA_MAGIC)
+	if err != nil {
+		return err
+	}
+
+	m := match{output: out}
+	buf := make([]byte, 32*1024)
+
+	// Of the copies starting before pos, best reaches furthest
+	var best *segment
+	i := 0
+	for pos := uint64(0); pos < uint64(size); {
+		for ; i < len(copies) && copies[i].pos <= pos; i++ {
+			if best == nil || copies[i].pos+copies[i].length > best.pos+best.length {
+				best = &copies[i]
+			}
+		}
+
+		if best != nil && best.pos+best.length > pos {
+			end := best.pos + best.length
+			if end > uint64(size) {
+				end = uint64(size)
+			}
+			if err := m.add(MATCH_KIND_COPY, best.start+pos-best.pos, end-pos); err != nil {
+				return err
+			}
+			pos = end
+			continue
+		}
+
+		end := uint64(size)
+		if i < len(copies) && copies[i].pos < end {
+			end = copies[i].pos
+		}
+		for pos < end {
+			n := uint64(len(buf))
+			if n > end-pos {
+				n = end - pos
+			}
+			if _, err := base.ReadAt(buf[:n], int64(pos)); err != nil {
+				return err
+			}
+			for _, b := range buf[:n] {
+				if err := m.add(MATCH_KIND_LITERAL, uint64(b), 1); err != nil {
+					return err
+				}
+			}
+			pos += n
+		}
+	}
+
+	if err := m.flush(); err != nil {
+		return err
+	}
+
+	return binary.Write(out, binary.BigEndian, OP_END)
+}
@@ -1,5 +1,19 @@
 package librsync
 
+import "fmt"
+
+// RollingHash is a weak checksum over a window of bytes that can be slid
+// along the input one byte at a time. The signature magic selects which
+// implementation Signature and Delta use.
+type RollingHash interface {
+	Update(p []byte)
+	Rollin(in byte)
+	Rollout(out byte)
+	Rotate(out, in byte)
+	Digest() uint32
+	Reset()
+}
+
 type Rollsum struct {
 	count  uint64
 	s1, s2 uint16
@@ -17,7 +31,26 @@ func NewRollsum() Rollsum {
 	return Rollsum{}
 }
 
-func (r *Rollsum) Update(p []byte) {
+func NewRollingHash(sigType MagicNumber) (RollingHash, error) {
+	switch sigType {
+	case BLAKE2_SIG_MAGIC, KEYED_BLAKE2_SIG_MAGIC, MD4_SIG_MAGIC:
+		sum := NewRollsum()
+		return &sum, nil
+	case RK_BLAKE2_SIG_MAGIC, RK_MD4_SIG_MAGIC:
+		sum := NewRabinKarp()
+		return &sum, nil
+	}
+	return nil, fmt.Errorf("invalid sigType %#x", sigType)
+}
+
+func (r *Rollsum) updateGeneric(p []byte) {
+	r.sum(p)
+	r.offset(len(p))
+}
+
+// sum adds the raw bytes of p to the checksum, without the per byte
+// ROLLSUM_CHAR_OFFSET which offset adds separately.
+func (r *Rollsum) sum(p []byte) {
 	l := len(p)
 
 	for n := 0; n < l; {
@@ -33,14 +66,16 @@ func (r *Rollsum) Update(p []byte) {
 			n += 1
 		}
 	}
+}
 
+func (r *Rollsum) offset(l int) {
 	r.s1 += uint16(l * ROLLSUM_CHAR_OFFSET)
 	r.s2 += uint16(((l * (l + 1)) / 2) * ROLLSUM_CHAR_OFFSET)
 	r.count += uint64(l)
 }
 
 func (r *Rollsum) Rotate(out, in byte) {
-	r.s1 += uint16(in - out)
+	r.s1 += uint16(in) - uint16(out)
 	r.s2 += r.s1 - uint16(r.count)*(uint16(out)+uint16(ROLLSUM_CHAR_OFFSET))
 }
 
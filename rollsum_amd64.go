@@ -0,0 +1,39 @@
+//go:build amd64 && !purego
+
+package librsync
+
+import "golang.org/x/sys/cpu"
+
+var (
+	useAVX2  = cpu.X86.HasAVX2
+	useSSSE3 = cpu.X86.HasSSSE3
+)
+
+// rollsumAVX2 and rollsumSSSE3 return the byte sum and the weighted byte sum
+// (see addSums) of p, ignoring any trailing bytes that don't fill a whole
+// 32 or 16 byte vector respectively.
+//
+//go:noescape
+func rollsumAVX2(p []byte) (sum, wsum uint32)
+
+//go:noescape
+func rollsumSSSE3(p []byte) (sum, wsum uint32)
+
+func (r *Rollsum) Update(p []byte) {
+	l := len(p)
+	n := 0
+
+	switch {
+	case useAVX2 && l >= 32:
+		n = l &^ 31
+		sum, wsum := rollsumAVX2(p[:n])
+		r.addSums(n, sum, wsum)
+	case useSSSE3 && l >= 16:
+		n = l &^ 15
+		sum, wsum := rollsumSSSE3(p[:n])
+		r.addSums(n, sum, wsum)
+	}
+
+	r.sum(p[n:])
+	r.offset(l)
+}
@@ -0,0 +1,133 @@
+//go:build amd64 && !purego
+
+#include "textflag.h"
+
+// Byte weights 32..1, the distance of each byte from the end of a 32 byte
+// vector. The SSSE3 kernel uses the last 16 of them.
+DATA weights<>+0x00(SB)/8, $0x191a1b1c1d1e1f20
+DATA weights<>+0x08(SB)/8, $0x1112131415161718
+DATA weights<>+0x10(SB)/8, $0x090a0b0c0d0e0f10
+DATA weights<>+0x18(SB)/8, $0x0102030405060708
+GLOBL weights<>(SB), RODATA|NOPTR, $32
+
+DATA ones<>+0x00(SB)/8, $0x0001000100010001
+DATA ones<>+0x08(SB)/8, $0x0001000100010001
+DATA ones<>+0x10(SB)/8, $0x0001000100010001
+DATA ones<>+0x18(SB)/8, $0x0001000100010001
+GLOBL ones<>(SB), RODATA|NOPTR, $32
+
+// For every vector of input, with S the sum of its bytes and W the sum of its
+// bytes weighted by their distance from the end of the vector, the loops keep
+// A += S, B += A (before adding S) and C += W in 32 bit lanes. Then
+// sum = A and wsum = size * B + C.
+
+// func rollsumSSSE3(p []byte) (sum, wsum uint32)
+TEXT ·rollsumSSSE3(SB), NOSPLIT, $0-32
+	MOVQ p_base+0(FP), SI
+	MOVQ p_len+8(FP), CX
+	SHRQ $4, CX
+
+	PXOR  X0, X0
+	PXOR  X1, X1
+	PXOR  X2, X2
+	PXOR  X3, X3
+	MOVOU weights<>+0x10(SB), X4
+	MOVOU ones<>(SB), X5
+
+	TESTQ CX, CX
+	JZ    reduce
+
+loop:
+	MOVOU     (SI), X6
+	MOVO      X6, X7
+	PSADBW    X0, X7
+	PADDL     X1, X2
+	PADDL     X7, X1
+	PMADDUBSW X4, X6
+	PMADDWL   X5, X6
+	PADDL     X6, X3
+	ADDQ      $16, SI
+	DECQ      CX
+	JNZ       loop
+
+reduce:
+	PSHUFD $0x4e, X1, X6
+	PADDL  X6, X1
+	PSHUFD $0xb1, X1, X6
+	PADDL  X6, X1
+	PSHUFD $0x4e, X2, X6
+	PADDL  X6, X2
+	PSHUFD $0xb1, X2, X6
+	PADDL  X6, X2
+	PSHUFD $0x4e, X3, X6
+	PADDL  X6, X3
+	PSHUFD $0xb1, X3, X6
+	PADDL  X6, X3
+
+	MOVL X1, AX
+	MOVL X2, BX
+	MOVL X3, DX
+	SHLL $4, BX
+	ADDL DX, BX
+	MOVL AX, sum+24(FP)
+	MOVL BX, wsum+28(FP)
+	RET
+
+// func rollsumAVX2(p []byte) (sum, wsum uint32)
+TEXT ·rollsumAVX2(SB), NOSPLIT, $0-32
+	MOVQ p_base+0(FP), SI
+	MOVQ p_len+8(FP), CX
+	SHRQ $5, CX
+
+	VPXOR   Y0, Y0, Y0
+	VPXOR   Y1, Y1, Y1
+	VPXOR   Y2, Y2, Y2
+	VPXOR   Y3, Y3, Y3
+	VMOVDQU weights<>(SB), Y4
+	VMOVDQU ones<>(SB), Y5
+
+	TESTQ CX, CX
+	JZ    reduce
+
+loop:
+	VMOVDQU    (SI), Y6
+	VPSADBW    Y0, Y6, Y7
+	VPADDD     Y1, Y2, Y2
+	VPADDD     Y7, Y1, Y1
+	VPMADDUBSW Y4, Y6, Y6
+	VPMADDWD   Y5, Y6, Y6
+	VPADDD     Y6, Y3, Y3
+	ADDQ       $32, SI
+	DECQ       CX
+	JNZ        loop
+
+reduce:
+	VEXTRACTI128 $1, Y1, X6
+	VPADDD       X6, X1, X1
+	VEXTRACTI128 $1, Y2, X6
+	VPADDD       X6, X2, X2
+	VEXTRACTI128 $1, Y3, X6
+	VPADDD       X6, X3, X3
+	VZEROUPPER
+
+	PSHUFD $0x4e, X1, X6
+	PADDL  X6, X1
+	PSHUFD $0xb1, X1, X6
+	PADDL  X6, X1
+	PSHUFD $0x4e, X2, X6
+	PADDL  X6, X2
+	PSHUFD $0xb1, X2, X6
+	PADDL  X6, X2
+	PSHUFD $0x4e, X3, X6
+	PADDL  X6, X3
+	PSHUFD $0xb1, X3, X6
+	PADDL  X6, X3
+
+	MOVL X1, AX
+	MOVL X2, BX
+	MOVL X3, DX
+	SHLL $5, BX
+	ADDL DX, BX
+	MOVL AX, sum+24(FP)
+	MOVL BX, wsum+28(FP)
+	RET
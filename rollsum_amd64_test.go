@@ -0,0 +1,23 @@
+//go:build amd64 && !purego
+
+package librsync
+
+// forEachRollsum calls fn with every implementation of Update this CPU
+// supports selected in turn.
+func forEachRollsum(fn func(impl string)) {
+	avx2, ssse3 := useAVX2, useSSSE3
+	defer func() {
+		useAVX2, useSSSE3 = avx2, ssse3
+	}()
+
+	if avx2 {
+		useAVX2, useSSSE3 = true, false
+		fn("avx2")
+	}
+	if ssse3 {
+		useAVX2, useSSSE3 = false, true
+		fn("ssse3")
+	}
+	useAVX2, useSSSE3 = false, false
+	fn("generic")
+}
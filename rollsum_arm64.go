@@ -0,0 +1,23 @@
+//go:build arm64 && !purego
+
+package librsync
+
+// rollsumNEON returns the byte sum and the weighted byte sum (see addSums) of
+// p, ignoring any trailing bytes that don't fill a whole 16 byte vector.
+//
+//go:noescape
+func rollsumNEON(p []byte) (sum, wsum uint32)
+
+func (r *Rollsum) Update(p []byte) {
+	l := len(p)
+	n := 0
+
+	if l >= 16 {
+		n = l &^ 15
+		sum, wsum := rollsumNEON(p[:n])
+		r.addSums(n, sum, wsum)
+	}
+
+	r.sum(p[n:])
+	r.offset(l)
+}
@@ -0,0 +1,49 @@
+//go:build arm64 && !purego
+
+#include "textflag.h"
+
+// Byte weights 16..1, the distance of each byte from the end of a vector.
+DATA weights<>+0x00(SB)/8, $0x090a0b0c0d0e0f10
+DATA weights<>+0x08(SB)/8, $0x0102030405060708
+GLOBL weights<>(SB), RODATA|NOPTR, $16
+
+// For every vector of input, with S the sum of its bytes and W the sum of its
+// bytes weighted by their distance from the end of the vector, the loop keeps
+// A += S, B += A (before adding S) and C += W. Then sum = A and
+// wsum = 16 * B + C.
+
+// func rollsumNEON(p []byte) (sum, wsum uint32)
+TEXT ·rollsumNEON(SB), NOSPLIT, $0-32
+	MOVD p_base+0(FP), R0
+	MOVD p_len+8(FP), R1
+	LSR  $4, R1, R1
+
+	MOVD $0, R2
+	MOVD $0, R3
+	MOVD $0, R4
+	MOVD $weights<>(SB), R5
+	VLD1 (R5), [V5.B16]
+
+	CBZ R1, done
+
+loop:
+	VLD1.P  16(R0), [V0.B16]
+	VUADDLV V0.B16, V1
+	VUMULL  V5.B8, V0.B8, V2.H8
+	VUMULL2 V5.B16, V0.B16, V3.H8
+	VADD    V3.H8, V2.H8, V2.H8
+	VUADDLV V2.H8, V4
+	VMOV    V1.H[0], R6
+	VMOV    V4.S[0], R7
+	ADD     R2, R3, R3
+	ADD     R6, R2, R2
+	ADD     R7, R4, R4
+	SUBS    $1, R1, R1
+	BNE     loop
+
+done:
+	LSL  $4, R3, R3
+	ADD  R4, R3, R3
+	MOVW R2, sum+24(FP)
+	MOVW R3, wsum+28(FP)
+	RET
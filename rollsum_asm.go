@@ -0,0 +1,12 @@
+//go:build (amd64 || arm64) && !purego
+
+package librsync
+
+// addSums folds the result of a vectorized kernel over n bytes into r. sum is
+// the plain sum of the bytes and wsum the sum of each byte weighted by its
+// distance from the end of the input, which is what the generic loop adds to
+// s1 and s2 respectively on top of n times the previous s1.
+func (r *Rollsum) addSums(n int, sum, wsum uint32) {
+	r.s2 += uint16(n)*r.s1 + uint16(wsum)
+	r.s1 += uint16(sum)
+}
@@ -0,0 +1,7 @@
+//go:build !(amd64 || arm64) || purego
+
+package librsync
+
+func (r *Rollsum) Update(p []byte) {
+	r.updateGeneric(p)
+}
@@ -0,0 +1,11 @@
+//go:build !amd64 || purego
+
+package librsync
+
+import "runtime"
+
+// forEachRollsum calls fn with the only implementation of Update, which is
+// vectorized on arm64.
+func forEachRollsum(fn func(impl string)) {
+	fn(runtime.GOARCH)
+}
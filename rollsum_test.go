@@ -0,0 +1,60 @@
+package librsync
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// checkUpdate compares Update with updateGeneric on p, starting from init.
+func checkUpdate(t testing.TB, impl string, init Rollsum, p []byte) {
+	a, b := init, init
+	a.Update(p)
+	b.updateGeneric(p)
+	if a != b {
+		t.Fatalf("%s: len %d from %+v: got %+v, want %+v", impl, len(p), init, a, b)
+	}
+}
+
+func TestRollsumUpdate(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	buf := make([]byte, 5000+32)
+
+	forEachRollsum(func(impl string) {
+		for l := 0; l <= 5000; l++ {
+			// Random data at varying alignments, and all 0xff to check
+			// for overflows
+			off := l % 32
+			p := buf[off : off+l]
+			r.Read(p)
+			checkUpdate(t, impl, Rollsum{}, p)
+
+			init := Rollsum{count: uint64(r.Intn(1000)), s1: uint16(r.Uint32()), s2: uint16(r.Uint32())}
+			checkUpdate(t, impl, init, p)
+
+			for i := range p {
+				p[i] = 0xff
+			}
+			checkUpdate(t, impl, Rollsum{}, p)
+		}
+
+		big := make([]byte, 1<<22+77)
+		for i := range big {
+			big[i] = 0xff
+		}
+		checkUpdate(t, impl, Rollsum{}, big)
+		r.Read(big)
+		checkUpdate(t, impl, Rollsum{s1: 5, s2: 9}, big)
+	})
+}
+
+func FuzzRollsumUpdate(f *testing.F) {
+	f.Add([]byte("The quick brown fox jumps over the lazy dog"), uint16(0), uint16(0))
+	f.Add(make([]byte, 100), uint16(1), uint16(2))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, uint16(0xffff), uint16(0xffff))
+
+	f.Fuzz(func(t *testing.T, p []byte, s1, s2 uint16) {
+		forEachRollsum(func(impl string) {
+			checkUpdate(t, impl, Rollsum{s1: s1, s2: s2}, p)
+		})
+	})
+}
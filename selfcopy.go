@@ -0,0 +1,105 @@
+package librsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// selfIndex remembers the literal data written to a delta in blockLen sized
+// blocks, so that later occurrences of the same data can be copied from the
+// output instead, see DeltaOptions.SelfCopy.
+type selfIndex struct {
+	blockLen uint32
+	weakSum  RollingHash
+	weak2pos map[uint32]uint64
+	blocks   map[uint64][]byte
+	// Keep the latest rather than the first occurrence of a block, for
+	// deltas with a window
+	latest bool
+}
+
+func newSelfIndex(sig *SignatureType) (*selfIndex, error) {
+	weakSum, err := NewRollingHash(sig.sigType)
+	if err != nil {
+		return nil, err
+	}
+	return &selfIndex{
+		blockLen: sig.blockLen,
+		weakSum:  weakSum,
+		weak2pos: make(map[uint32]uint64),
+		blocks:   make(map[uint64][]byte),
+	}, nil
+}
+
+// add indexes a copy of block, which was written at pos of the output.
+func (s *selfIndex) add(pos uint64, block []byte) {
+	s.weakSum.Reset()
+	s.weakSum.Update(block)
+	prev, ok := s.weak2pos[s.weakSum.Digest()]
+	if ok && !s.latest {
+		return
+	}
+	if ok {
+		delete(s.blocks, prev)
+	}
+	s.weak2pos[s.weakSum.Digest()] = pos
+	s.blocks[pos] = append([]byte{}, block...)
+}
+
+// find returns the output position of an indexed block equal to p, whose weak
+// sum is weak.
+func (s *selfIndex) find(weak uint32, p []byte) (uint64, bool) {
+	pos, ok := s.weak2pos[weak]
+	if !ok || !bytes.Equal(s.blocks[pos], p) {
+		return 0, false
+	}
+	return pos, true
+}
+
+// outputHistory keeps everything written to it for Patch to self copy from
+// when the output can't be read back.
+type outputHistory struct {
+	buf []byte
+}
+
+func (h *outputHistory) Write(p []byte) (int, error) {
+	h.buf = append(h.buf, p...)
+	return len(p), nil
+}
+
+func (h *outputHistory) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(h.buf).ReadAt(p, off)
+}
+
+// selfCopy appends len bytes from pos of the output, of which size bytes were
+// written so far, to out. The source may overlap the data being copied, in
+// which case it repeats.
+func selfCopy(out io.Writer, written io.ReaderAt, size, pos, len int64) error {
+	buf := make([]byte, 32*1024)
+
+	for len > 0 {
+		n := int64(cap(buf))
+		if n > len {
+			n = len
+		}
+		if n > size-pos {
+			n = size - pos
+		}
+		if n <= 0 {
+			return fmt.Errorf("self copy from %d beyond output of %d bytes", pos, size)
+		}
+
+		if _, err := written.ReadAt(buf[:n], pos); err != nil {
+			return err
+		}
+		if _, err := out.Write(buf[:n]); err != nil {
+			return err
+		}
+		pos += n
+		len -= n
+		size += n
+	}
+
+	return nil
+}
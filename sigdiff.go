@@ -0,0 +1,73 @@
+package librsync
+
+import (
+	"bytes"
+	"fmt"
+)
+
+type BlockMove struct {
+	From, To int
+}
+
+// SignatureDiff describes how the blocks of one signature changed into those
+// of another. Indexes refer to the old signature for Removed and
+// BlockMove.From and to the new one otherwise.
+type SignatureDiff struct {
+	// New blocks past the end of the old signature with unknown content
+	Added []int
+	// Old blocks whose content is gone, unless reported as Changed
+	Removed []int
+	// Blocks present in both whose content changed to something unknown
+	Changed []int
+	// New blocks whose content is found at another index of the old signature
+	Moved []BlockMove
+}
+
+func (d *SignatureDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && len(d.Moved) == 0
+}
+
+// DiffSignatures compares two signatures created with the same parameters
+// without access to either file.
+func DiffSignatures(old, new *SignatureType) (*SignatureDiff, error) {
+	if old.sigType != new.sigType || old.blockLen != new.blockLen || old.strongLen != new.strongLen {
+		return nil, fmt.Errorf("signatures have different parameters")
+	}
+	if !bytes.Equal(old.key, new.key) {
+		return nil, fmt.Errorf("signatures have different keys")
+	}
+
+	oldBlocks := make(map[string]int)
+	for i := len(old.strongSigs) - 1; i >= 0; i-- {
+		oldBlocks[string(old.strongSigs[i])] = i
+	}
+	newBlocks := make(map[string]bool)
+	for _, s := range new.strongSigs {
+		newBlocks[string(s)] = true
+	}
+
+	var diff SignatureDiff
+	changed := make(map[int]bool)
+
+	for i, s := range new.strongSigs {
+		if i < len(old.strongSigs) && bytes.Equal(s, old.strongSigs[i]) {
+			continue
+		}
+		if j, ok := oldBlocks[string(s)]; ok {
+			diff.Moved = append(diff.Moved, BlockMove{From: j, To: i})
+		} else if i < len(old.strongSigs) {
+			diff.Changed = append(diff.Changed, i)
+			changed[i] = true
+		} else {
+			diff.Added = append(diff.Added, i)
+		}
+	}
+
+	for j, s := range old.strongSigs {
+		if !newBlocks[string(s)] && !changed[j] {
+			diff.Removed = append(diff.Removed, j)
+		}
+	}
+
+	return &diff, nil
+}
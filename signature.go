@@ -1,6 +1,7 @@
 package librsync
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -12,22 +13,34 @@ import (
 const (
 	BLAKE2_SUM_LENGTH = 32
 	MD4_SUM_LENGTH    = 16
+
+	// Length of the random key stored in KEYED_BLAKE2_SIG_MAGIC signatures
+	BLAKE2_KEY_LENGTH = 32
 )
 
 type SignatureType struct {
 	sigType    MagicNumber
 	blockLen   uint32
 	strongLen  uint32
+	key        []byte
+	weakSigs   []uint32
 	strongSigs [][]byte
 	weak2block map[uint32]int
+
+	// Base offset of each block, if they aren't consecutive
+	offsets []uint64
+
+	// Only for CDC_BLAKE2_SIG_MAGIC
+	chunks       []cdcChunk
+	strong2chunk map[string]int
 }
 
 func CalcStrongSum(data []byte, sigType MagicNumber, strongLen uint32) ([]byte, error) {
 	switch sigType {
-	case BLAKE2_SIG_MAGIC:
+	case BLAKE2_SIG_MAGIC, RK_BLAKE2_SIG_MAGIC, CDC_BLAKE2_SIG_MAGIC:
 		d := blake2b.Sum256(data)
 		return d[:strongLen], nil
-	case MD4_SIG_MAGIC:
+	case MD4_SIG_MAGIC, RK_MD4_SIG_MAGIC:
 		d := md4.New()
 		d.Write(data)
 		return d.Sum(nil)[:strongLen], nil
@@ -35,36 +48,52 @@ func CalcStrongSum(data []byte, sigType MagicNumber, strongLen uint32) ([]byte,
 	return nil, fmt.Errorf("Invalid sigType %#x", sigType)
 }
 
-func Signature(input io.Reader, output io.Writer, blockLen, strongLen uint32, sigType MagicNumber) (*SignatureType, error) {
-	var maxStrongLen uint32
+func CalcKeyedStrongSum(data []byte, key []byte, strongLen uint32) ([]byte, error) {
+	d, err := blake2b.New256(key)
+	if err != nil {
+		return nil, err
+	}
+	d.Write(data)
+	return d.Sum(nil)[:strongLen], nil
+}
 
-	switch sigType {
-	case BLAKE2_SIG_MAGIC:
-		maxStrongLen = BLAKE2_SUM_LENGTH
-	case MD4_SIG_MAGIC:
-		maxStrongLen = MD4_SUM_LENGTH
-	default:
-		return nil, fmt.Errorf("invalid sigType %#x", sigType)
+func (s *SignatureType) strongSum(data []byte) ([]byte, error) {
+	if s.sigType == KEYED_BLAKE2_SIG_MAGIC {
+		return CalcKeyedStrongSum(data, s.key, s.strongLen)
 	}
+	return CalcStrongSum(data, s.sigType, s.strongLen)
+}
 
-	if strongLen > maxStrongLen {
-		return nil, fmt.Errorf("invalid strongLen %d for sigType %#x", strongLen, sigType)
+func (s *SignatureType) blockOffset(idx int) uint64 {
+	if s.offsets != nil {
+		return s.offsets[idx]
 	}
+	return uint64(idx) * uint64(s.blockLen)
+}
 
-	err := binary.Write(output, binary.BigEndian, sigType)
-	if err != nil {
-		return nil, err
+func maxStrongLen(sigType MagicNumber) (uint32, error) {
+	switch sigType {
+	case BLAKE2_SIG_MAGIC, KEYED_BLAKE2_SIG_MAGIC, RK_BLAKE2_SIG_MAGIC, CDC_BLAKE2_SIG_MAGIC:
+		return BLAKE2_SUM_LENGTH, nil
+	case MD4_SIG_MAGIC, RK_MD4_SIG_MAGIC:
+		return MD4_SUM_LENGTH, nil
 	}
-	err = binary.Write(output, binary.BigEndian, blockLen)
+	return 0, fmt.Errorf("invalid sigType %#x", sigType)
+}
+
+func Signature(input io.Reader, output io.Writer, blockLen, strongLen uint32, sigType MagicNumber) (*SignatureType, error) {
+	max, err := maxStrongLen(sigType)
 	if err != nil {
 		return nil, err
 	}
-	err = binary.Write(output, binary.BigEndian, strongLen)
-	if err != nil {
-		return nil, err
+
+	if strongLen > max {
+		return nil, fmt.Errorf("invalid strongLen %d for sigType %#x", strongLen, sigType)
 	}
 
-	block := make([]byte, blockLen)
+	if sigType == CDC_BLAKE2_SIG_MAGIC && (blockLen < cdcMinBlockLen || blockLen > cdcMaxBlockLen) {
+		return nil, fmt.Errorf("invalid blockLen %d for sigType %#x", blockLen, sigType)
+	}
 
 	var ret SignatureType
 	ret.weak2block = make(map[uint32]int)
@@ -72,6 +101,31 @@ func Signature(input io.Reader, output io.Writer, blockLen, strongLen uint32, si
 	ret.strongLen = strongLen
 	ret.blockLen = blockLen
 
+	if sigType == KEYED_BLAKE2_SIG_MAGIC {
+		ret.key = make([]byte, BLAKE2_KEY_LENGTH)
+		if _, err := io.ReadFull(rand.Reader, ret.key); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ret.writeHeader(output); err != nil {
+		return nil, err
+	}
+
+	if sigType == CDC_BLAKE2_SIG_MAGIC {
+		if err := signatureCDC(input, output, &ret); err != nil {
+			return nil, err
+		}
+		return &ret, nil
+	}
+
+	weakSum, err := NewRollingHash(sigType)
+	if err != nil {
+		return nil, err
+	}
+
+	block := make([]byte, blockLen)
+
 	for {
 		n, err := io.ReadFull(input, block)
 		if err == io.ErrUnexpectedEOF || err == io.EOF {
@@ -81,17 +135,140 @@ func Signature(input io.Reader, output io.Writer, blockLen, strongLen uint32, si
 		}
 		data := block[:n]
 
-		weak := WeakChecksum(data)
+		weakSum.Reset()
+		weakSum.Update(data)
+		weak := weakSum.Digest()
 		err = binary.Write(output, binary.BigEndian, weak)
 		if err != nil {
 			return nil, err
 		}
 
-		strong, _ := CalcStrongSum(data, sigType, strongLen)
+		strong, _ := ret.strongSum(data)
 		output.Write(strong)
 
-		ret.weak2block[weak] = len(ret.strongSigs)
-		ret.strongSigs = append(ret.strongSigs, strong)
+		ret.addBlock(weak, strong)
+	}
+
+	return &ret, nil
+}
+
+func (s *SignatureType) writeHeader(output io.Writer) error {
+	err := binary.Write(output, binary.BigEndian, s.sigType)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(output, binary.BigEndian, s.blockLen)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(output, binary.BigEndian, s.strongLen)
+	if err != nil {
+		return err
+	}
+	if s.key != nil {
+		_, err = output.Write(s.key)
+	}
+	return err
+}
+
+func (s *SignatureType) addBlock(weak uint32, strong []byte) {
+	s.weak2block[weak] = len(s.strongSigs)
+	s.weakSigs = append(s.weakSigs, weak)
+	s.strongSigs = append(s.strongSigs, strong)
+}
+
+// WriteTo writes the signature in the same format as Signature.
+func (s *SignatureType) WriteTo(output io.Writer) (int64, error) {
+	w := &countWriter{w: output, limit: -1}
+
+	if err := s.writeHeader(w); err != nil {
+		return w.n, err
+	}
+
+	for i, strong := range s.strongSigs {
+		var err error
+		if s.chunks != nil {
+			err = writeChunk(w, s.chunks[i], strong)
+		} else {
+			err = binary.Write(w, binary.BigEndian, s.weakSigs[i])
+			if err == nil {
+				_, err = w.Write(strong)
+			}
+		}
+		if err != nil {
+			return w.n, err
+		}
+	}
+
+	return w.n, nil
+}
+
+// ReadSignature parses a signature file as written by Signature, which may
+// be compressed, see DecompressReader.
+func ReadSignature(input io.Reader) (*SignatureType, error) {
+	d, err := DecompressReader(input)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	input = d
+
+	var ret SignatureType
+	ret.weak2block = make(map[uint32]int)
+
+	err = binary.Read(input, binary.BigEndian, &ret.sigType)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(input, binary.BigEndian, &ret.blockLen)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Read(input, binary.BigEndian, &ret.strongLen)
+	if err != nil {
+		return nil, err
+	}
+
+	max, err := maxStrongLen(ret.sigType)
+	if err != nil {
+		return nil, err
+	}
+	if ret.strongLen > max {
+		return nil, fmt.Errorf("invalid strongLen %d for sigType %#x", ret.strongLen, ret.sigType)
+	}
+
+	if ret.sigType == KEYED_BLAKE2_SIG_MAGIC {
+		ret.key = make([]byte, BLAKE2_KEY_LENGTH)
+		if _, err := io.ReadFull(input, ret.key); err != nil {
+			return nil, err
+		}
+	}
+
+	if ret.sigType == CDC_BLAKE2_SIG_MAGIC {
+		if ret.blockLen < cdcMinBlockLen || ret.blockLen > cdcMaxBlockLen {
+			return nil, fmt.Errorf("invalid blockLen %d for sigType %#x", ret.blockLen, ret.sigType)
+		}
+		if err := readSignatureCDC(input, &ret); err != nil {
+			return nil, err
+		}
+		return &ret, nil
+	}
+
+	for {
+		var weak uint32
+		err := binary.Read(input, binary.BigEndian, &weak)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		strong := make([]byte, ret.strongLen)
+		if _, err := io.ReadFull(input, strong); err != nil {
+			return nil, err
+		}
+
+		ret.addBlock(weak, strong)
 	}
 
 	return &ret, nil
@@ -0,0 +1,121 @@
+package librsync
+
+import (
+	"io"
+)
+
+// Runs of zeros are skipped in blocks of this size, aligned in the output,
+// which is what file systems allocate in.
+const sparseBlockLen = 4096
+
+// SparseFile is an output of PatchSparse, like *os.File.
+type SparseFile interface {
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// PatchSparse applies delta to base like Patch, but writes the result to out
+// with all blocks of zeros left out, so that they become holes where the file
+// system supports them. out is truncated first and to the size of the result
+// last.
+func PatchSparse(base io.ReadSeeker, delta io.Reader, out SparseFile) error {
+	return patchSparse(base, delta, out, nil)
+}
+
+// patchSparse is PatchSparse with self copies reading the output back from
+// ra, if given, which must read out.
+func patchSparse(base io.ReadSeeker, delta io.Reader, out SparseFile, ra io.ReaderAt) error {
+	if err := out.Truncate(0); err != nil {
+		return err
+	}
+
+	w := &sparseWriter{file: out, ra: ra}
+	var readBack io.ReaderAt
+	if ra != nil {
+		readBack = w
+	}
+	if err := patch(base, delta, w, readBack); err != nil {
+		return err
+	}
+
+	return out.Truncate(w.n)
+}
+
+// sparseWriter writes to file sequentially, skipping blocks of zeros.
+type sparseWriter struct {
+	file SparseFile
+	ra   io.ReaderAt
+	// Number of bytes written
+	n int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Find the end of the data to write, if any, and of the zeros after it
+		data := 0
+		for data < len(p) {
+			l := blockRemaining(w.n+int64(data), len(p)-data)
+			if isZero(p[data : data+l]) {
+				break
+			}
+			data += l
+		}
+		zeros := data
+		for zeros < len(p) {
+			l := blockRemaining(w.n+int64(zeros), len(p)-zeros)
+			if !isZero(p[zeros : zeros+l]) {
+				break
+			}
+			zeros += l
+		}
+
+		if data > 0 {
+			n, err := w.file.WriteAt(p[:data], w.n)
+			w.n += int64(n)
+			written += n
+			if err != nil {
+				return written, err
+			}
+		}
+		w.n += int64(zeros - data)
+		written += zeros - data
+		p = p[zeros:]
+	}
+	return written, nil
+}
+
+// ReadAt reads back what was written, including zeros past the end of the
+// file that it wasn't truncated to yet.
+func (w *sparseWriter) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > w.n {
+		return 0, io.EOF
+	}
+
+	n, err := w.ra.ReadAt(p, off)
+	if err == io.EOF {
+		for i := n; i < len(p); i++ {
+			p[i] = 0
+		}
+		return len(p), nil
+	}
+	return n, err
+}
+
+// blockRemaining returns how many of n bytes from pos lie in the same
+// sparseBlockLen block.
+func blockRemaining(pos int64, n int) int {
+	if l := int(sparseBlockLen - pos%sparseBlockLen); l < n {
+		return l
+	}
+	return n
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
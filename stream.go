@@ -0,0 +1,170 @@
+package librsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// PatchStream applies delta to a basis that can only be read forward, like a
+// pipe from a decompressor. The delta must have been created with
+// DeltaOptions.Monotonic; a copy from before the end of the previous one is
+// an error. As the basis can't be checked before patching, a wrong basis is
+// only reported once the output was written.
+func PatchStream(base io.Reader, delta io.Reader, out io.Writer) error {
+	return patchForward(base, delta, out, 0)
+}
+
+// PatchWindow applies delta to a basis read forward like PatchStream, but
+// keeps the last window bytes of the basis and of the output in ring buffers
+// for copies to reach back to, which is all the memory it needs. The delta
+// must have been created with a DeltaOptions.Window of at most window.
+func PatchWindow(base io.Reader, delta io.Reader, out io.Writer, window int) error {
+	if window <= 0 {
+		return fmt.Errorf("invalid window %d", window)
+	}
+	return patchForward(base, delta, out, window)
+}
+
+// patchForward reads base forward keeping the last window bytes of it, and of
+// the output unless window is 0.
+func patchForward(base io.Reader, delta io.Reader, out io.Writer, window int) error {
+	d, err := newDeltaReader(delta)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	header := d.header
+
+	if window > 0 && header != nil && header.Window > uint64(window) {
+		return fmt.Errorf("delta needs a window of %d bytes rather than %d", header.Window, window)
+	}
+
+	basisSum, _ := blake2b.New256(nil)
+	basis := &ring{buf: make([]byte, window)}
+	base = io.TeeReader(base, io.MultiWriter(basis, basisSum))
+
+	o := newPatchOutput(out, header, window, nil)
+	out = o.counter
+
+	for {
+		kind, param1, param2, lit, err := d.next()
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		default:
+			return fmt.Errorf("Bogus command %x", kind)
+		case KIND_LITERAL:
+			if _, err := io.CopyN(out, lit, param1); err != nil {
+				return err
+			}
+		case KIND_COPY:
+			if window == 0 && param1 < basis.n {
+				return fmt.Errorf("copy from %d is behind basis position %d, delta isn't monotonic", param1, basis.n)
+			}
+			if param1 < basis.n-int64(window) {
+				return fmt.Errorf("copy from %d is more than %d bytes behind basis position %d", param1, window, basis.n)
+			}
+			if param1 < basis.n {
+				n := basis.n - param1
+				if n > param2 {
+					n = param2
+				}
+				if err := selfCopy(out, basis, basis.n, param1, n); err != nil {
+					return err
+				}
+				param1 += n
+				param2 -= n
+			}
+			if param2 > 0 {
+				if _, err := io.CopyN(io.Discard, base, param1-basis.n); err != nil {
+					return err
+				}
+				if _, err := io.CopyN(out, base, param2); err != nil {
+					return err
+				}
+			}
+		case KIND_SELF_COPY:
+			if err := selfCopy(out, o.written, o.counter.n, param1, param2); err != nil {
+				return err
+			}
+		case KIND_END:
+			if err := o.checkLen(header); err != nil {
+				return err
+			}
+
+			sum, basisExpected, err := readTrailer(d.r)
+			if err != nil {
+				return err
+			}
+
+			var expected [][]byte
+			if len(basisExpected) > 0 {
+				expected = append(expected, basisExpected)
+			}
+			if header != nil && len(header.BasisChecksum) > 0 {
+				expected = append(expected, header.BasisChecksum)
+			}
+
+			// The rest of the basis is only read to check it
+			if len(expected) > 0 || (header != nil && header.BasisLen >= 0) {
+				if _, err := io.Copy(io.Discard, base); err != nil {
+					return err
+				}
+				if header != nil && header.BasisLen >= 0 && basis.n != header.BasisLen {
+					return fmt.Errorf("basis is %d bytes rather than expected %d", basis.n, header.BasisLen)
+				}
+				for _, e := range expected {
+					if !bytes.Equal(basisSum.Sum(nil), e) {
+						return ErrBasisChecksumMismatch
+					}
+				}
+			}
+
+			if sum != nil && !bytes.Equal(o.checksum.Sum(nil), sum) {
+				return ErrChecksumMismatch
+			}
+			return nil
+		}
+	}
+}
+
+// ring keeps the last len(buf) bytes written to it.
+type ring struct {
+	buf []byte
+	// Number of bytes written
+	n int64
+}
+
+func (r *ring) Write(p []byte) (int, error) {
+	size := int64(len(r.buf))
+	l := len(p)
+	if int64(l) > size {
+		r.n += int64(l) - size
+		p = p[int64(l)-size:]
+	}
+
+	for len(p) > 0 {
+		c := copy(r.buf[r.n%size:], p)
+		p = p[c:]
+		r.n += int64(c)
+	}
+	return l, nil
+}
+
+func (r *ring) ReadAt(p []byte, off int64) (int, error) {
+	size := int64(len(r.buf))
+	if off < r.n-size || off+int64(len(p)) > r.n {
+		return 0, fmt.Errorf("offset %d is outside the window of %d bytes", off, size)
+	}
+
+	n := 0
+	for n < len(p) {
+		n += copy(p[n:], r.buf[(off+int64(n))%size:])
+	}
+	return n, nil
+}
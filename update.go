@@ -0,0 +1,164 @@
+package librsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// UpdateSignature returns the signature of the file produced by patching base
+// with delta, identical to running Signature on it, given oldSig, the
+// signature of base. Blocks that delta copies whole from block aligned
+// offsets of base reuse the sums in oldSig, so only the rest of the new file
+// is read and hashed. For deltas with self copies the literal data of delta
+// is held in memory.
+func UpdateSignature(oldSig *SignatureType, base io.ReaderAt, delta io.Reader) (*SignatureType, error) {
+	if oldSig.sigType == CDC_BLAKE2_SIG_MAGIC || oldSig.offsets != nil {
+		return nil, fmt.Errorf("invalid sigType %#x for UpdateSignature", oldSig.sigType)
+	}
+
+	weakSum, err := NewRollingHash(oldSig.sigType)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := SignatureType{
+		sigType:    oldSig.sigType,
+		blockLen:   oldSig.blockLen,
+		strongLen:  oldSig.strongLen,
+		key:        oldSig.key,
+		weak2block: make(map[uint32]int),
+	}
+
+	blockLen := int64(oldSig.blockLen)
+	block := make([]byte, 0, blockLen)
+
+	// fill appends up to n bytes read by read to block and returns how many
+	// it took, signing block once it is full.
+	fill := func(n int64, read func(p []byte) error) (int64, error) {
+		if l := blockLen - int64(len(block)); n > l {
+			n = l
+		}
+		p := block[len(block) : int64(len(block))+n]
+		if err := read(p); err != nil {
+			return 0, err
+		}
+		block = block[:len(block)+len(p)]
+
+		if int64(len(block)) == blockLen {
+			weakSum.Reset()
+			weakSum.Update(block)
+			strong, err := ret.strongSum(block)
+			if err != nil {
+				return 0, err
+			}
+			ret.addBlock(weakSum.Digest(), strong)
+			block = block[:0]
+		}
+		return n, nil
+	}
+
+	// copyBase appends n bytes from pos of base, reusing the sums of whole
+	// blocks copied from block aligned offsets
+	copyBase := func(pos, n int64) error {
+		for n > 0 {
+			idx := pos / blockLen
+			if len(block) == 0 && pos%blockLen == 0 && n >= blockLen && idx < int64(len(oldSig.strongSigs)) {
+				ret.addBlock(oldSig.weakSigs[idx], oldSig.strongSigs[idx])
+				pos += blockLen
+				n -= blockLen
+				continue
+			}
+
+			c, err := fill(n, func(p []byte) error {
+				n, err := base.ReadAt(p, pos)
+				if n == len(p) {
+					return nil
+				} else if err == io.EOF {
+					return io.ErrUnexpectedEOF
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			pos += c
+			n -= c
+		}
+		return nil
+	}
+
+	// copyLiteral appends the literal data lit
+	copyLiteral := func(lit io.Reader, n int64) error {
+		for n > 0 {
+			c, err := fill(n, func(p []byte) error {
+				_, err := io.ReadFull(lit, p)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			n -= c
+		}
+		return nil
+	}
+
+	d, err := newDeltaReader(delta)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	// Self copies are resolved through a map of the new file, which holds its
+	// literal data
+	var out *segmentMap
+	if d.header != nil && d.header.Flags&DELTA_FLAG_SELF_COPY != 0 {
+		out = &segmentMap{}
+	}
+
+	for {
+		kind, param1, param2, lit, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		default:
+			return nil, fmt.Errorf("Bogus command %x", kind)
+		case KIND_LITERAL:
+			if out != nil {
+				var data bytes.Buffer
+				if _, err := io.CopyN(&data, lit, param1); err != nil {
+					return nil, err
+				}
+				if err := out.add(MATCH_KIND_LITERAL, 0, uint64(param1), data.Bytes()); err != nil {
+					return nil, err
+				}
+				lit = &data
+			}
+			err = copyLiteral(lit, param1)
+		case KIND_COPY:
+			if out != nil {
+				if err := out.add(MATCH_KIND_COPY, uint64(param1), uint64(param2), nil); err != nil {
+					return nil, err
+				}
+			}
+			err = copyBase(param1, param2)
+		case KIND_SELF_COPY:
+			err = out.add(MATCH_KIND_SELF, uint64(param1), uint64(param2), nil)
+			if err == nil {
+				err = out.resolve(out.size-uint64(param2), uint64(param2), func(kind matchKind, pos, length uint64, lit []byte) error {
+					if kind == MATCH_KIND_LITERAL {
+						return copyLiteral(bytes.NewReader(lit), int64(length))
+					}
+					return copyBase(int64(pos), int64(length))
+				})
+			}
+		case KIND_END:
+			return &ret, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
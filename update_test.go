@@ -0,0 +1,62 @@
+package librsync
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestUpdateSignatureSelfCopy(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		p := make([]byte, n)
+		r.Read(p)
+		return p
+	}
+
+	// The new file repeats data that isn't in the old one, for self copies
+	old := random(100000)
+	added := random(20000)
+	var nw []byte
+	nw = append(nw, old[:30000]...)
+	nw = append(nw, added...)
+	nw = append(nw, old[30000:60000]...)
+	nw = append(nw, added...)
+	nw = append(nw, added[:5000]...)
+	nw = append(nw, old[60000:]...)
+
+	for _, sigType := range []MagicNumber{BLAKE2_SIG_MAGIC, MD4_SIG_MAGIC, RK_BLAKE2_SIG_MAGIC, RK_MD4_SIG_MAGIC} {
+		var oldSigBuf bytes.Buffer
+		oldSig, err := Signature(bytes.NewReader(old), &oldSigBuf, 512, 16, sigType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var delta, plain bytes.Buffer
+		if err := DeltaWithOptions(oldSig, bytes.NewReader(nw), &delta, &DeltaOptions{SelfCopy: true}); err != nil {
+			t.Fatal(err)
+		}
+		if err := Delta(oldSig, bytes.NewReader(nw), &plain); err != nil {
+			t.Fatal(err)
+		}
+		if delta.Len() >= plain.Len() {
+			t.Fatalf("%#x: delta with self copies is %d bytes, plain delta %d", sigType, delta.Len(), plain.Len())
+		}
+
+		updated, err := UpdateSignature(oldSig, bytes.NewReader(old), bytes.NewReader(delta.Bytes()))
+		if err != nil {
+			t.Fatalf("%#x: %v", sigType, err)
+		}
+
+		var got, want bytes.Buffer
+		if _, err := updated.WriteTo(&got); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Signature(bytes.NewReader(nw), &want, 512, 16, sigType); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatalf("%#x: updated signature differs from the signature of the new file", sigType)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package librsync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// ErrUnverifiedTail is returned by Verify if file ends in a partial block,
+// which fixed size block signatures don't cover.
+var ErrUnverifiedTail = errors.New("file ends in a partial block the signature doesn't cover")
+
+// Verify checks file against sig and returns the indexes of the blocks that
+// differ, so an empty result means file matches the signature. Blocks missing
+// at the end of file are reported as differing, and so is data past the last
+// block of sig, as index len(blocks). Like Signature, it skips a trailing
+// partial block of fixed size block signatures, and then returns the
+// differing blocks along with ErrUnverifiedTail.
+func Verify(sig *SignatureType, file io.Reader) ([]int, error) {
+	var diff []int
+
+	blockLen := func(idx int) int {
+		if sig.chunks != nil {
+			return int(sig.chunks[idx].length)
+		}
+		return int(sig.blockLen)
+	}
+
+	maxLen := int(sig.blockLen)
+	for i := range sig.chunks {
+		if blockLen(i) > maxLen {
+			maxLen = blockLen(i)
+		}
+	}
+	block := make([]byte, maxLen)
+
+	for i := range sig.strongSigs {
+		data := block[:blockLen(i)]
+		_, err := io.ReadFull(file, data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			for ; i < len(sig.strongSigs); i++ {
+				diff = append(diff, i)
+			}
+			return diff, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		strong, err := sig.strongSum(data)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(strong, sig.strongSigs[i]) {
+			diff = append(diff, i)
+		}
+	}
+
+	// Anything left over is an extra block, unless it's the partial block
+	// that Signature leaves out.
+	extra := int(sig.blockLen)
+	if sig.sigType == CDC_BLAKE2_SIG_MAGIC {
+		extra = 1
+	}
+	n, err := io.ReadFull(file, block[:extra])
+	if n == extra {
+		diff = append(diff, len(sig.strongSigs))
+	} else if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	} else if n > 0 {
+		return diff, ErrUnverifiedTail
+	}
+
+	return diff, nil
+}